@@ -3,8 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"sort"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mattermost/mattermost-server/model"
@@ -26,15 +25,40 @@ func (p *Plugin) OnActivate() error {
 		}
 	}
 
+	p.nodeID = getNodeID()
 	if err := p.retreiveData(); err != nil {
 		return err
 	}
+	if err := p.registerNode(); err != nil {
+		p.API.LogError("can't register node", "err", err.Error())
+	}
+	if err := p.heartbeat(); err != nil {
+		p.API.LogError("can't send heartbeat", "err", err.Error())
+	}
+	if err := p.indexOwnPartials(); err != nil {
+		p.API.LogError("can't index partials", "err", err.Error())
+	}
+	p.rolloverBucket()
+	// taking the leader lock and claiming late reports wait for other nodes, don't block the activation
+	go func() {
+		if p.acquireLeadership() {
+			p.mergePartials()
+			p.catchUpSchedules()
+		}
+	}()
 
-	c, err := NewCron(p)
+	p.cronLock.Lock()
+	c, err := NewCron(p, p.getSchedules())
 	if err != nil {
+		p.cronLock.Unlock()
 		return err
 	}
 	p.cron = c
+	p.cronLock.Unlock()
+
+	if err := p.resumeBackfill(); err != nil {
+		p.API.LogError("can't resume backfill", "err", err.Error())
+	}
 
 	return nil
 }
@@ -44,9 +68,10 @@ func (p *Plugin) registerCommand(teamID string) error {
 		TeamId:           teamID,
 		Trigger:          CommandTrigger,
 		AutoComplete:     true,
-		AutoCompleteDesc: "Display analytics of this channel",
-		DisplayName:      "Analytics of this channel",
-		Description:      "A command used to show analytics of this channel.",
+		AutoCompleteDesc: "Display analytics of this channel, or use help to list all subcommands",
+		AutoCompleteHint: getAutocompleteHint(),
+		DisplayName:      "Analytics",
+		Description:      "A command used to show analytics of this channel, team, a user, files or trends.",
 	}); err != nil {
 		return errors.Wrap(err, "failed to register command")
 	}
@@ -67,87 +92,73 @@ func (p *Plugin) OnDeactivate() error {
 		}
 	}
 
+	p.cronLock.Lock()
 	p.cron.Stop()
+	p.cronLock.Unlock()
+	p.stopBackfill()
+	p.releaseLeadership()
 
 	return nil
 }
 
 // ServeHTTP is called by mattermost when an http request is made to this plugin
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
-	var err error
-	switch r.URL.Path {
-	case "/line.svg":
-		err = p.handleLine(w, r)
-	case "/pie.svg":
-		p.handlePie(w, r)
-	case "/bar.svg":
-		p.handleBar(w, r)
-	default:
-		http.NotFound(w, r)
+	if strings.HasPrefix(r.URL.Path, apiPrefix) {
+		p.serveAPI(w, r)
+		return
 	}
-	if err != nil {
-		p.API.LogError("Error rendering chart", "err", err.Error())
+
+	if strings.HasPrefix(r.URL.Path, chartPrefix) {
+		p.handleChart(w, r)
+		return
 	}
-}
 
-func (p *Plugin) handleLine(w http.ResponseWriter, r *http.Request) error {
-	times := make([]time.Time, 0)
-	yvalues := make(map[string][]float64, 0)
-	max := -1.0
-	for key, values := range r.URL.Query() {
-		if key == "amp" {
-			continue
-		} else if key == "date" {
-			for _, stringDate := range values {
-				i, _ := strconv.ParseInt(stringDate, 10, 64)
-				t := time.Unix(i, 0)
-				times = append(times, t)
-			}
-		} else {
-			yvalue := make([]float64, 0)
-			for _, value := range values {
-				v, err := strconv.ParseFloat(value, 64)
-				if err != nil {
-					p.API.LogError("can't parse value", "value", value, "url", r.URL.String())
-					v = 0
-				}
-				if v > max {
-					max = v
-				}
-				yvalue = append(yvalue, v)
-			}
-			yvalues[key] = yvalue
-		}
+	// charts are only drawn from specs stored with reports, never from data given in the url
+	if r.URL.Path == "/metrics" {
+		p.handleMetrics(w, r)
+		return
 	}
+	http.NotFound(w, r)
+}
 
+// renderLine draw a line chart with a line by series, each series must have a value by time
+func (p *Plugin) renderLine(w http.ResponseWriter, format chartFormat, times []time.Time, series []chartSeries) error {
 	if len(times) < 2 {
-		return fmt.Errorf("Not enought time to draw a chart %d for url %s", len(times), r.URL.String())
+		return fmt.Errorf("Not enought time to draw a chart %d", len(times))
 	}
 
+	max := -1.0
 	chartSeries := make([]chart.Series, 0)
-	for key, yvalue := range yvalues {
-		nbYValue := len(yvalue)
+	for _, s := range series {
+		nbYValue := len(s.Values)
 		nbTimes := len(times)
 		if nbYValue == nbTimes {
+			for _, v := range s.Values {
+				if v > max {
+					max = v
+				}
+			}
 			chartSeries = append(chartSeries,
 				chart.TimeSeries{
-					Name:    key,
+					Name:    s.Name,
 					XValues: times,
-					YValues: yvalue,
+					YValues: s.Values,
 				},
 			)
 		} else {
-			p.API.LogDebug("Not enought data to draw line", "name", key, "nbTimes", nbTimes, "nbData", nbYValue, "url", r.URL.String())
+			p.API.LogDebug("Not enought data to draw line", "name", s.Name, "nbTimes", nbTimes, "nbData", nbYValue)
 		}
 	}
 
 	if len(chartSeries) < 1 {
-		return fmt.Errorf("Not enought data to draw a chart %d for url %s", len(chartSeries), r.URL.String())
+		return fmt.Errorf("Not enought data to draw a chart %d", len(chartSeries))
 	}
 
+	width, height := format.size(800, 300)
 	graph := chart.Chart{
-		Width:  800,
-		Height: 300,
+		Width:  width,
+		Height: height,
+		DPI:    format.dpi,
 		XAxis: chart.XAxis{
 			Style: chart.StyleShow(),
 		},
@@ -162,50 +173,35 @@ func (p *Plugin) handleLine(w http.ResponseWriter, r *http.Request) error {
 		chart.Legend(&graph),
 	}
 
-	w.Header().Set("Content-Type", chart.ContentTypeSVG)
-	return graph.Render(chart.SVG, w)
+	w.Header().Set("Content-Type", format.contentType)
+	return graph.Render(format.provider, w)
 }
 
-func (p *Plugin) handlePie(w http.ResponseWriter, r *http.Request) {
-	values := make([]chart.Value, 0)
-	for key, value := range r.URL.Query() {
-		if key == "amp" {
-			continue
-		}
-		v, _ := strconv.ParseFloat(value[0], 64)
-		values = append(values, chart.Value{Value: v, Label: key})
-	}
-	sort.Slice(values, func(i, j int) bool {
-		return values[i].Label < values[j].Label
-	})
+func (p *Plugin) renderPie(w http.ResponseWriter, format chartFormat, values []chart.Value) error {
+	width, height := format.size(300, 300)
 	graph := chart.PieChart{
-		Width:  300,
-		Height: 300,
+		Width:  width,
+		Height: height,
+		DPI:    format.dpi,
 		Values: values,
 	}
 
-	w.Header().Set("Content-Type", chart.ContentTypeSVG)
-	err := graph.Render(chart.SVG, w)
-	if err != nil {
-		p.API.LogError("Error rendering pie chart", "err", err.Error())
-	}
+	w.Header().Set("Content-Type", format.contentType)
+	return graph.Render(format.provider, w)
 }
 
-func (p *Plugin) handleBar(w http.ResponseWriter, r *http.Request) {
-	values := make([]chart.Value, 0)
+func (p *Plugin) renderBar(w http.ResponseWriter, format chartFormat, values []chart.Value) error {
 	max := -1.0
-	for key, value := range r.URL.Query() {
-		if key != "amp" {
-			v, _ := strconv.ParseFloat(value[0], 64)
-			if v > max {
-				max = v
-			}
-			values = append(values, chart.Value{Value: v, Label: key})
+	for _, value := range values {
+		if value.Value > max {
+			max = value.Value
 		}
 	}
+	width, height := format.size(600, 300)
 	graph := chart.BarChart{
-		Width:  600,
-		Height: 300,
+		Width:  width,
+		Height: height,
+		DPI:    format.dpi,
 		XAxis:  chart.StyleShow(),
 		YAxis: chart.YAxis{
 			Style: chart.StyleShow(),
@@ -214,9 +210,6 @@ func (p *Plugin) handleBar(w http.ResponseWriter, r *http.Request) {
 		Bars: values,
 	}
 
-	w.Header().Set("Content-Type", chart.ContentTypeSVG)
-	err := graph.Render(chart.SVG, w)
-	if err != nil {
-		p.API.LogError("Error rendering bar chart", "err", err.Error())
-	}
+	w.Header().Set("Content-Type", format.contentType)
+	return graph.Render(format.provider, w)
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	// activityLookback is the number of days before a period loaded to compute MAU and new posters
+	activityLookback = 30
+)
+
+// activeUsersDay is the number of active users of a day, users who posted at least one message
+type activeUsersDay struct {
+	Day time.Time `json:"day"`
+	DAU int64     `json:"dau"`
+	WAU int64     `json:"wau"`
+	MAU int64     `json:"mau"`
+}
+
+// activeUsers is the active users of each day of a period, and posters of the period compared to the previous days
+type activeUsers struct {
+	Days []activeUsersDay `json:"days"`
+	// Stickiness is the average DAU divided by the MAU of the last day, in percent
+	Stickiness int64 `json:"stickiness"`
+	// New posters didn't post during the activityLookback days before the period, returning ones did
+	New       int64 `json:"new"`
+	Returning int64 `json:"returning"`
+}
+
+// activeUsersSince return the start of the history read to compute active users of a period
+// days start at midnight in location
+func activeUsersSince(pe period, location *time.Location) time.Time {
+	return dayStart(pe.since.In(location)).AddDate(0, 0, -activityLookback)
+}
+
+// getActiveUsers compute active users of each day of a period, keep filter channels like FilterChannels
+// days start at midnight in location, buckets compacted by day are counted in the day of their start
+func getActiveUsers(h *history, pe period, keep func(channelID string) bool, location *time.Location) *activeUsers {
+	days := make([]time.Time, 0)
+	index := make(map[time.Time]int)
+	end := pe.end()
+	for day := activeUsersSince(pe, location); day.Before(end); day = day.AddDate(0, 0, 1) {
+		index[day] = len(days)
+		days = append(days, day)
+	}
+	users := make([]map[string]bool, len(days))
+	for i := range users {
+		users[i] = make(map[string]bool)
+	}
+	for _, bucket := range h.buckets {
+		i, ok := index[dayStart(bucket.Start.In(location))]
+		if !ok || !bucket.Start.Before(end) {
+			continue
+		}
+		if keep == nil {
+			for userID := range bucket.Users {
+				users[i][userID] = true
+			}
+			continue
+		}
+		for channelID, channelUsers := range bucket.ChannelsUsers {
+			if !keep(channelID) {
+				continue
+			}
+			for userID := range channelUsers {
+				users[i][userID] = true
+			}
+		}
+	}
+	return newActiveUsers(days, users, activityLookback)
+}
+
+// newActiveUsers build active users of days after the first lookback ones from users who posted each day
+func newActiveUsers(days []time.Time, users []map[string]bool, lookback int) *activeUsers {
+	result := &activeUsers{Days: make([]activeUsersDay, 0)}
+	if len(days) <= lookback {
+		return result
+	}
+	window := func(end int, size int) int64 {
+		distinct := make(map[string]bool)
+		for index := end - size + 1; index <= end; index++ {
+			if index < 0 {
+				continue
+			}
+			for userID := range users[index] {
+				distinct[userID] = true
+			}
+		}
+		return int64(len(distinct))
+	}
+
+	totalDAU := int64(0)
+	for index := lookback; index < len(days); index++ {
+		day := activeUsersDay{
+			Day: days[index],
+			DAU: int64(len(users[index])),
+			WAU: window(index, 7),
+			MAU: window(index, 30),
+		}
+		totalDAU += day.DAU
+		result.Days = append(result.Days, day)
+	}
+	last := result.Days[len(result.Days)-1]
+	result.Stickiness = percentOf(totalDAU, last.MAU*int64(len(result.Days)))
+
+	// posters of the period not seen before are the growth of the union of both
+	before := window(lookback-1, lookback)
+	period := window(len(days)-1, len(days)-lookback)
+	all := window(len(days)-1, len(days))
+	result.New = all - before
+	result.Returning = period - result.New
+	return result
+}
+
+// getActiveUsersFields tell DAU, WAU and MAU of the last day of the period and draw their series
+func (p *Plugin) getActiveUsersFields(siteURL string, active *activeUsers) ([]*model.SlackAttachmentField, error) {
+	if len(active.Days) == 0 {
+		return nil, nil
+	}
+	last := active.Days[len(active.Days)-1]
+	m := "### Active users\n"
+	m = m + fmt.Sprintf("* **%d** daily, **%d** weekly and **%d** monthly active users, stickiness **%d%%**.\n", last.DAU, last.WAU, last.MAU, active.Stickiness)
+	m = m + fmt.Sprintf("* **%d** new posters and **%d** returning ones, compared to the %d previous days.\n", active.New, active.Returning, activityLookback)
+	if len(active.Days) < 2 {
+		return []*model.SlackAttachmentField{{Short: true, Value: m}}, nil
+	}
+
+	spec := &chartSpec{Kind: lineChart}
+	dau := chartSeries{Name: "DAU"}
+	wau := chartSeries{Name: "WAU"}
+	mau := chartSeries{Name: "MAU"}
+	for _, day := range active.Days {
+		spec.Dates = append(spec.Dates, day.Day.Unix())
+		dau.Values = append(dau.Values, float64(day.DAU))
+		wau.Values = append(wau.Values, float64(day.WAU))
+		mau.Values = append(mau.Values, float64(day.MAU))
+	}
+	spec.Series = []chartSeries{dau, wau, mau}
+	urlChart, err := p.saveChart(siteURL, spec)
+	if err != nil {
+		return nil, err
+	}
+	return buildSlackAttachmentField(m, "active users line chart", urlChart), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveUsers(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	days := make([]time.Time, 0)
+	users := make([]map[string]bool, 0)
+	// user1 posts every day, user2 once before the period, user3 only during the period
+	for index := 0; index < 4; index++ {
+		day := map[string]bool{"user1": true}
+		if index == 0 {
+			day["user2"] = true
+		}
+		if index == 3 {
+			day["user3"] = true
+		}
+		days = append(days, start.AddDate(0, 0, index))
+		users = append(users, day)
+	}
+
+	active := newActiveUsers(days, users, 2)
+	assert.Len(active.Days, 2)
+	assert.Equal(start.AddDate(0, 0, 2), active.Days[0].Day)
+	assert.Equal(int64(1), active.Days[0].DAU)
+	assert.Equal(int64(2), active.Days[0].MAU)
+	assert.Equal(int64(2), active.Days[1].DAU)
+	assert.Equal(int64(3), active.Days[1].WAU)
+	assert.Equal(int64(3), active.Days[1].MAU)
+	assert.Equal(int64(50), active.Stickiness)
+	assert.Equal(int64(1), active.New)
+	assert.Equal(int64(1), active.Returning)
+
+	assert.Len(newActiveUsers(days, users, 4).Days, 0)
+}
+
+func TestGetActiveUsersLocation(t *testing.T) {
+	assert := assert.New(t)
+
+	paris, err := time.LoadLocation("Europe/Paris")
+	assert.Nil(err)
+	since := time.Date(2019, 3, 10, 0, 0, 0, 0, paris)
+	pe := period{since: since, until: since.AddDate(0, 0, 1)}
+	assert.Equal(since.AddDate(0, 0, -activityLookback), activeUsersSince(pe, paris))
+
+	// 23:30 UTC is already the next day in Paris
+	late := NewAnalytic()
+	late.Start = time.Date(2019, 3, 9, 23, 30, 0, 0, time.UTC)
+	late.Users["user1"] = 1
+	late.ChannelsUsers["channel1"] = map[string]int64{"user1": 1}
+	other := NewAnalytic()
+	other.Start = time.Date(2019, 3, 10, 12, 0, 0, 0, time.UTC)
+	other.Users["user2"] = 1
+	other.ChannelsUsers["channel2"] = map[string]int64{"user2": 1}
+	h := &history{buckets: []*Analytic{late, other}}
+
+	active := getActiveUsers(h, pe, nil, paris)
+	assert.Len(active.Days, 1)
+	assert.True(since.Equal(active.Days[0].Day))
+	assert.Equal(int64(2), active.Days[0].DAU)
+	assert.Equal(int64(2), active.New)
+
+	active = getActiveUsers(h, pe, func(channelID string) bool { return channelID == "channel1" }, paris)
+	assert.Equal(int64(1), active.Days[0].DAU)
+
+	active = getActiveUsers(h, pe, nil, time.UTC)
+	assert.Equal(int64(1), active.Days[0].DAU)
+}
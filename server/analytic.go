@@ -5,7 +5,11 @@ import (
 	"time"
 )
 
-// Analytic is a session of metrics to generate a report.
+// bucketDuration is the length of the time buckets where metrics are recorded
+// reports of any period are built by merging all buckets of this period
+const bucketDuration = time.Hour
+
+// Analytic is a bucket of metrics recorded between Start and End, or a merge of buckets to generate a report.
 // See `NewAnalytic()` to build one
 type Analytic struct {
 	lock sync.RWMutex
@@ -25,34 +29,270 @@ type Analytic struct {
 	FilesNb int64
 	// FilesSize store weigth of files uploaded
 	FilesSize int64
+	// ChannelsUsers store number of messages by user id for each channel id
+	ChannelsUsers map[string]map[string]int64
+	// ChannelsUsersReply store number of reply by user id for each channel id
+	ChannelsUsersReply map[string]map[string]int64
+	// ChannelsFilesNb store number of files uploaded by channel id
+	ChannelsFilesNb map[string]int64
+	// ChannelsFilesSize store weigth of files uploaded by channel id
+	ChannelsFilesSize map[string]int64
+	// ReactionsGiven store number of reactions added by user id
+	ReactionsGiven map[string]int64
+	// ReactionsReceived store number of reactions received on their posts by user id
+	ReactionsReceived map[string]int64
+	// Emojis store number of reactions by emoji name
+	Emojis map[string]int64
+	// ChannelsReactions store number of reactions by channel id
+	ChannelsReactions map[string]int64
+	// ChannelsReactionsGiven store number of reactions added by user id for each channel id
+	ChannelsReactionsGiven map[string]map[string]int64
+	// ChannelsReactionsReceived store number of reactions received by user id for each channel id
+	ChannelsReactionsReceived map[string]map[string]int64
+	// ChannelsEmojis store number of reactions by emoji name for each channel id
+	ChannelsEmojis map[string]map[string]int64
+	// UsersEdits store number of edited messages by user id
+	UsersEdits map[string]int64
+	// UsersDeletes store number of deleted messages by author id
+	UsersDeletes map[string]int64
+	// ChannelsEdits store number of edited messages by channel id
+	ChannelsEdits map[string]int64
+	// ChannelsDeletes store number of deleted messages by channel id
+	ChannelsDeletes map[string]int64
+	// ChannelsUsersEdits store number of edited messages by user id for each channel id
+	ChannelsUsersEdits map[string]map[string]int64
+	// ChannelsUsersDeletes store number of deleted messages by author id for each channel id
+	ChannelsUsersDeletes map[string]map[string]int64
+	// ChannelsAnswered store number of threads which got their first response by channel id
+	// a response is a reply of another user than the author of the root post
+	ChannelsAnswered map[string]int64
+	// ChannelsParticipants store number of users who joined threads by channel id, authors of root posts excluded
+	ChannelsParticipants map[string]int64
+	// ChannelsResponseTimes store number of first responses by upper bound of their delay for each channel id
+	// see responseTimeBounds
+	ChannelsResponseTimes map[string]map[string]int64
+	// UsersFirstResponses store number of first responses by user id
+	UsersFirstResponses map[string]int64
+	// UsersResponseTime store sum of the delays of first responses in seconds by user id
+	UsersResponseTime map[string]int64
+	// ChannelsUsersFirstResponses store number of first responses by user id for each channel id
+	ChannelsUsersFirstResponses map[string]map[string]int64
+	// ChannelsUsersResponseTime store sum of the delays of first responses in seconds by user id for each channel id
+	ChannelsUsersResponseTime map[string]map[string]int64
+	// Heatmap store number of messages by weekday and hour, see heatmapKey
+	Heatmap map[string]int64
+	// ChannelsHeatmap store number of messages by weekday and hour for each channel id
+	ChannelsHeatmap map[string]map[string]int64
+	// Sources store number of messages by source, see postSources
+	// it counts all posts, even the ones of sources left out of other metrics
+	Sources map[string]int64
+	// ChannelsSources store number of messages by source for each channel id
+	ChannelsSources map[string]map[string]int64
+	// Teams store number of messages by team id, direct messages have no team
+	Teams map[string]int64
+	// TeamsChannels store number of messages by channel id for each team id
+	TeamsChannels map[string]map[string]int64
+	// TeamsUsers store number of messages by user id for each team id
+	TeamsUsers map[string]map[string]int64
+	// UsersFilesNb store number of files posted by user id
+	UsersFilesNb map[string]int64
+	// UsersFilesSize store weigth of files posted by user id
+	UsersFilesSize map[string]int64
+	// ChannelsUsersFilesNb store number of files posted by user id for each channel id
+	ChannelsUsersFilesNb map[string]map[string]int64
+	// ChannelsUsersFilesSize store weigth of files posted by user id for each channel id
+	ChannelsUsersFilesSize map[string]map[string]int64
 }
 
 // NewAnalytic return a struct to store all data needed to generate a report
 func NewAnalytic() *Analytic {
 	return &Analytic{
-		lock:          sync.RWMutex{},
-		Start:         time.Now(),
-		Channels:      make(map[string]int64),
-		ChannelsReply: make(map[string]int64),
-		Users:         make(map[string]int64),
-		UsersReply:    make(map[string]int64),
-		FilesNb:       int64(0),
-		FilesSize:     int64(0),
+		lock:               sync.RWMutex{},
+		Start:              bucketStart(time.Now()),
+		Channels:           make(map[string]int64),
+		ChannelsReply:      make(map[string]int64),
+		Users:              make(map[string]int64),
+		UsersReply:         make(map[string]int64),
+		FilesNb:            int64(0),
+		FilesSize:          int64(0),
+		ChannelsUsers:      make(map[string]map[string]int64),
+		ChannelsUsersReply: make(map[string]map[string]int64),
+		ChannelsFilesNb:    make(map[string]int64),
+		ChannelsFilesSize:  make(map[string]int64),
+
+		ReactionsGiven:            make(map[string]int64),
+		ReactionsReceived:         make(map[string]int64),
+		Emojis:                    make(map[string]int64),
+		ChannelsReactions:         make(map[string]int64),
+		ChannelsReactionsGiven:    make(map[string]map[string]int64),
+		ChannelsReactionsReceived: make(map[string]map[string]int64),
+		ChannelsEmojis:            make(map[string]map[string]int64),
+
+		UsersEdits:           make(map[string]int64),
+		UsersDeletes:         make(map[string]int64),
+		ChannelsEdits:        make(map[string]int64),
+		ChannelsDeletes:      make(map[string]int64),
+		ChannelsUsersEdits:   make(map[string]map[string]int64),
+		ChannelsUsersDeletes: make(map[string]map[string]int64),
+
+		ChannelsAnswered:            make(map[string]int64),
+		ChannelsParticipants:        make(map[string]int64),
+		ChannelsResponseTimes:       make(map[string]map[string]int64),
+		UsersFirstResponses:         make(map[string]int64),
+		UsersResponseTime:           make(map[string]int64),
+		ChannelsUsersFirstResponses: make(map[string]map[string]int64),
+		ChannelsUsersResponseTime:   make(map[string]map[string]int64),
+
+		Heatmap:         make(map[string]int64),
+		ChannelsHeatmap: make(map[string]map[string]int64),
+
+		Sources:         make(map[string]int64),
+		ChannelsSources: make(map[string]map[string]int64),
+
+		Teams:         make(map[string]int64),
+		TeamsChannels: make(map[string]map[string]int64),
+		TeamsUsers:    make(map[string]map[string]int64),
+
+		UsersFilesNb:           make(map[string]int64),
+		UsersFilesSize:         make(map[string]int64),
+		ChannelsUsersFilesNb:   make(map[string]map[string]int64),
+		ChannelsUsersFilesSize: make(map[string]map[string]int64),
 	}
 }
 
-// Init reinitialize an analytic to zero
-// TODO : remove me if possible
-func (a *Analytic) Init() {
-	a.Start = time.Now()
+// Rollover close the metrics recorded until end in a new analytic
+// and reinitialize this one to zero, starting at end. Caller must hold the write lock
+func (a *Analytic) Rollover(end time.Time) *Analytic {
+	closed := &Analytic{
+		Start:              a.Start,
+		End:                end,
+		Channels:           a.Channels,
+		ChannelsReply:      a.ChannelsReply,
+		Users:              a.Users,
+		UsersReply:         a.UsersReply,
+		FilesNb:            a.FilesNb,
+		FilesSize:          a.FilesSize,
+		ChannelsUsers:      a.ChannelsUsers,
+		ChannelsUsersReply: a.ChannelsUsersReply,
+		ChannelsFilesNb:    a.ChannelsFilesNb,
+		ChannelsFilesSize:  a.ChannelsFilesSize,
+
+		ReactionsGiven:            a.ReactionsGiven,
+		ReactionsReceived:         a.ReactionsReceived,
+		Emojis:                    a.Emojis,
+		ChannelsReactions:         a.ChannelsReactions,
+		ChannelsReactionsGiven:    a.ChannelsReactionsGiven,
+		ChannelsReactionsReceived: a.ChannelsReactionsReceived,
+		ChannelsEmojis:            a.ChannelsEmojis,
+
+		UsersEdits:           a.UsersEdits,
+		UsersDeletes:         a.UsersDeletes,
+		ChannelsEdits:        a.ChannelsEdits,
+		ChannelsDeletes:      a.ChannelsDeletes,
+		ChannelsUsersEdits:   a.ChannelsUsersEdits,
+		ChannelsUsersDeletes: a.ChannelsUsersDeletes,
+
+		ChannelsAnswered:            a.ChannelsAnswered,
+		ChannelsParticipants:        a.ChannelsParticipants,
+		ChannelsResponseTimes:       a.ChannelsResponseTimes,
+		UsersFirstResponses:         a.UsersFirstResponses,
+		UsersResponseTime:           a.UsersResponseTime,
+		ChannelsUsersFirstResponses: a.ChannelsUsersFirstResponses,
+		ChannelsUsersResponseTime:   a.ChannelsUsersResponseTime,
+
+		Heatmap:         a.Heatmap,
+		ChannelsHeatmap: a.ChannelsHeatmap,
+
+		Sources:         a.Sources,
+		ChannelsSources: a.ChannelsSources,
+
+		Teams:         a.Teams,
+		TeamsChannels: a.TeamsChannels,
+		TeamsUsers:    a.TeamsUsers,
+
+		UsersFilesNb:           a.UsersFilesNb,
+		UsersFilesSize:         a.UsersFilesSize,
+		ChannelsUsersFilesNb:   a.ChannelsUsersFilesNb,
+		ChannelsUsersFilesSize: a.ChannelsUsersFilesSize,
+	}
+
+	fresh := NewAnalytic()
+	a.Start = end
 	a.End = time.Time{}
-	a.Channels = make(map[string]int64)
-	a.ChannelsReply = make(map[string]int64)
-	a.Users = make(map[string]int64)
-	a.UsersReply = make(map[string]int64)
-	a.FilesNb = int64(0)
-	a.FilesSize = int64(0)
+	a.Channels = fresh.Channels
+	a.ChannelsReply = fresh.ChannelsReply
+	a.Users = fresh.Users
+	a.UsersReply = fresh.UsersReply
+	a.FilesNb = fresh.FilesNb
+	a.FilesSize = fresh.FilesSize
+	a.ChannelsUsers = fresh.ChannelsUsers
+	a.ChannelsUsersReply = fresh.ChannelsUsersReply
+	a.ChannelsFilesNb = fresh.ChannelsFilesNb
+	a.ChannelsFilesSize = fresh.ChannelsFilesSize
+	a.ReactionsGiven = fresh.ReactionsGiven
+	a.ReactionsReceived = fresh.ReactionsReceived
+	a.Emojis = fresh.Emojis
+	a.ChannelsReactions = fresh.ChannelsReactions
+	a.ChannelsReactionsGiven = fresh.ChannelsReactionsGiven
+	a.ChannelsReactionsReceived = fresh.ChannelsReactionsReceived
+	a.ChannelsEmojis = fresh.ChannelsEmojis
+	a.UsersEdits = fresh.UsersEdits
+	a.UsersDeletes = fresh.UsersDeletes
+	a.ChannelsEdits = fresh.ChannelsEdits
+	a.ChannelsDeletes = fresh.ChannelsDeletes
+	a.ChannelsUsersEdits = fresh.ChannelsUsersEdits
+	a.ChannelsUsersDeletes = fresh.ChannelsUsersDeletes
+	a.ChannelsAnswered = fresh.ChannelsAnswered
+	a.ChannelsParticipants = fresh.ChannelsParticipants
+	a.ChannelsResponseTimes = fresh.ChannelsResponseTimes
+	a.UsersFirstResponses = fresh.UsersFirstResponses
+	a.UsersResponseTime = fresh.UsersResponseTime
+	a.ChannelsUsersFirstResponses = fresh.ChannelsUsersFirstResponses
+	a.ChannelsUsersResponseTime = fresh.ChannelsUsersResponseTime
+	a.Heatmap = fresh.Heatmap
+	a.ChannelsHeatmap = fresh.ChannelsHeatmap
+	a.Sources = fresh.Sources
+	a.ChannelsSources = fresh.ChannelsSources
+	a.Teams = fresh.Teams
+	a.TeamsChannels = fresh.TeamsChannels
+	a.TeamsUsers = fresh.TeamsUsers
+	a.UsersFilesNb = fresh.UsersFilesNb
+	a.UsersFilesSize = fresh.UsersFilesSize
+	a.ChannelsUsersFilesNb = fresh.ChannelsUsersFilesNb
+	a.ChannelsUsersFilesSize = fresh.ChannelsUsersFilesSize
+	return closed
+}
+
+// period bound the metrics of a report, a zero until means up to now
+type period struct {
+	since time.Time
+	until time.Time
+}
+
+// contains tell if t is in this period
+func (pe period) contains(t time.Time) bool {
+	return !t.Before(pe.since) && (pe.until.IsZero() || t.Before(pe.until))
+}
 
+// end return until or now if this period is not bounded
+func (pe period) end() time.Time {
+	if pe.until.IsZero() {
+		return time.Now()
+	}
+	return pe.until
+}
+
+// withDefaultSince return this period with since set to duration before its end if missing
+func (pe period) withDefaultSince(duration time.Duration) period {
+	if pe.since.IsZero() {
+		pe.since = bucketStart(pe.end().Add(-duration))
+	}
+	return pe
+}
+
+// bucketStart return the start of the bucket containing t, buckets start on utc hours
+func bucketStart(t time.Time) time.Time {
+	return t.Truncate(bucketDuration)
 }
 
 // WLock to lock this analytic in write
@@ -75,8 +315,192 @@ func (a *Analytic) RUnlock() {
 	a.lock.RUnlock()
 }
 
-// Close this analytic by adding an End date
-func (a *Analytic) Close() *Analytic {
-	a.End = time.Now()
-	return a
+// incrementChannelUser add one message of userID in channelID to the given breakdown
+// it's also used with other keys than users, like emojis
+func incrementChannelUser(breakdown map[string]map[string]int64, channelID string, userID string) {
+	addChannelUser(breakdown, channelID, userID, 1)
+}
+
+// addChannelUser add nb messages of userID in channelID to the given breakdown, nb can be negative
+func addChannelUser(breakdown map[string]map[string]int64, channelID string, userID string, nb int64) {
+	users, ok := breakdown[channelID]
+	if !ok {
+		users = make(map[string]int64)
+		breakdown[channelID] = users
+	}
+	users[userID] += nb
+}
+
+// Merge add all metrics of other into this analytic
+// Start and End are left untouched, it's up to the caller to set them
+func (a *Analytic) Merge(other *Analytic) {
+	mergeCounts(a.Channels, other.Channels)
+	mergeCounts(a.ChannelsReply, other.ChannelsReply)
+	mergeCounts(a.Users, other.Users)
+	mergeCounts(a.UsersReply, other.UsersReply)
+	a.FilesNb += other.FilesNb
+	a.FilesSize += other.FilesSize
+	mergeBreakdowns(a.ChannelsUsers, other.ChannelsUsers)
+	mergeBreakdowns(a.ChannelsUsersReply, other.ChannelsUsersReply)
+	mergeCounts(a.ChannelsFilesNb, other.ChannelsFilesNb)
+	mergeCounts(a.ChannelsFilesSize, other.ChannelsFilesSize)
+	mergeCounts(a.ReactionsGiven, other.ReactionsGiven)
+	mergeCounts(a.ReactionsReceived, other.ReactionsReceived)
+	mergeCounts(a.Emojis, other.Emojis)
+	mergeCounts(a.ChannelsReactions, other.ChannelsReactions)
+	mergeBreakdowns(a.ChannelsReactionsGiven, other.ChannelsReactionsGiven)
+	mergeBreakdowns(a.ChannelsReactionsReceived, other.ChannelsReactionsReceived)
+	mergeBreakdowns(a.ChannelsEmojis, other.ChannelsEmojis)
+	mergeCounts(a.UsersEdits, other.UsersEdits)
+	mergeCounts(a.UsersDeletes, other.UsersDeletes)
+	mergeCounts(a.ChannelsEdits, other.ChannelsEdits)
+	mergeCounts(a.ChannelsDeletes, other.ChannelsDeletes)
+	mergeBreakdowns(a.ChannelsUsersEdits, other.ChannelsUsersEdits)
+	mergeBreakdowns(a.ChannelsUsersDeletes, other.ChannelsUsersDeletes)
+	mergeCounts(a.ChannelsAnswered, other.ChannelsAnswered)
+	mergeCounts(a.ChannelsParticipants, other.ChannelsParticipants)
+	mergeBreakdowns(a.ChannelsResponseTimes, other.ChannelsResponseTimes)
+	mergeCounts(a.UsersFirstResponses, other.UsersFirstResponses)
+	mergeCounts(a.UsersResponseTime, other.UsersResponseTime)
+	mergeBreakdowns(a.ChannelsUsersFirstResponses, other.ChannelsUsersFirstResponses)
+	mergeBreakdowns(a.ChannelsUsersResponseTime, other.ChannelsUsersResponseTime)
+	mergeCounts(a.Heatmap, other.Heatmap)
+	mergeBreakdowns(a.ChannelsHeatmap, other.ChannelsHeatmap)
+	mergeCounts(a.Sources, other.Sources)
+	mergeBreakdowns(a.ChannelsSources, other.ChannelsSources)
+	mergeCounts(a.Teams, other.Teams)
+	mergeBreakdowns(a.TeamsChannels, other.TeamsChannels)
+	mergeBreakdowns(a.TeamsUsers, other.TeamsUsers)
+	mergeCounts(a.UsersFilesNb, other.UsersFilesNb)
+	mergeCounts(a.UsersFilesSize, other.UsersFilesSize)
+	mergeBreakdowns(a.ChannelsUsersFilesNb, other.ChannelsUsersFilesNb)
+	mergeBreakdowns(a.ChannelsUsersFilesSize, other.ChannelsUsersFilesSize)
+}
+
+// FilterChannels return a new analytic with only metrics of channels accepted by keep
+// users and files metrics are rebuilt from channels breakdowns, caller must hold the read lock
+func (a *Analytic) FilterChannels(keep func(channelID string) bool) *Analytic {
+	filtered := NewAnalytic()
+	filtered.Start = a.Start
+	filtered.End = a.End
+	for channelID, nb := range a.Channels {
+		if !keep(channelID) {
+			continue
+		}
+		filtered.Channels[channelID] = nb
+		filtered.ChannelsReply[channelID] = a.ChannelsReply[channelID]
+		filtered.ChannelsUsers[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsUsers[channelID], a.ChannelsUsers[channelID])
+		mergeCounts(filtered.Users, a.ChannelsUsers[channelID])
+		filtered.ChannelsUsersReply[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsUsersReply[channelID], a.ChannelsUsersReply[channelID])
+		mergeCounts(filtered.UsersReply, a.ChannelsUsersReply[channelID])
+		filtered.ChannelsFilesNb[channelID] = a.ChannelsFilesNb[channelID]
+		filtered.FilesNb += a.ChannelsFilesNb[channelID]
+		filtered.ChannelsFilesSize[channelID] = a.ChannelsFilesSize[channelID]
+		filtered.FilesSize += a.ChannelsFilesSize[channelID]
+		filtered.ChannelsUsersFilesNb[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsUsersFilesNb[channelID], a.ChannelsUsersFilesNb[channelID])
+		mergeCounts(filtered.UsersFilesNb, a.ChannelsUsersFilesNb[channelID])
+		filtered.ChannelsUsersFilesSize[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsUsersFilesSize[channelID], a.ChannelsUsersFilesSize[channelID])
+		mergeCounts(filtered.UsersFilesSize, a.ChannelsUsersFilesSize[channelID])
+		filtered.ChannelsHeatmap[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsHeatmap[channelID], a.ChannelsHeatmap[channelID])
+		mergeCounts(filtered.Heatmap, a.ChannelsHeatmap[channelID])
+	}
+	// reactions can be added in channels without new messages in this bucket
+	for channelID, nb := range a.ChannelsReactions {
+		if !keep(channelID) {
+			continue
+		}
+		filtered.ChannelsReactions[channelID] = nb
+		filtered.ChannelsReactionsGiven[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsReactionsGiven[channelID], a.ChannelsReactionsGiven[channelID])
+		mergeCounts(filtered.ReactionsGiven, a.ChannelsReactionsGiven[channelID])
+		filtered.ChannelsReactionsReceived[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsReactionsReceived[channelID], a.ChannelsReactionsReceived[channelID])
+		mergeCounts(filtered.ReactionsReceived, a.ChannelsReactionsReceived[channelID])
+		filtered.ChannelsEmojis[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsEmojis[channelID], a.ChannelsEmojis[channelID])
+		mergeCounts(filtered.Emojis, a.ChannelsEmojis[channelID])
+	}
+	for channelID, nb := range a.ChannelsEdits {
+		if !keep(channelID) {
+			continue
+		}
+		filtered.ChannelsEdits[channelID] = nb
+		filtered.ChannelsUsersEdits[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsUsersEdits[channelID], a.ChannelsUsersEdits[channelID])
+		mergeCounts(filtered.UsersEdits, a.ChannelsUsersEdits[channelID])
+	}
+	for channelID, nb := range a.ChannelsDeletes {
+		if !keep(channelID) {
+			continue
+		}
+		filtered.ChannelsDeletes[channelID] = nb
+		filtered.ChannelsUsersDeletes[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsUsersDeletes[channelID], a.ChannelsUsersDeletes[channelID])
+		mergeCounts(filtered.UsersDeletes, a.ChannelsUsersDeletes[channelID])
+	}
+	// first responses can be posted in a bucket without new root posts
+	for channelID, nb := range a.ChannelsAnswered {
+		if !keep(channelID) {
+			continue
+		}
+		filtered.ChannelsAnswered[channelID] = nb
+		filtered.ChannelsResponseTimes[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsResponseTimes[channelID], a.ChannelsResponseTimes[channelID])
+		filtered.ChannelsUsersFirstResponses[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsUsersFirstResponses[channelID], a.ChannelsUsersFirstResponses[channelID])
+		mergeCounts(filtered.UsersFirstResponses, a.ChannelsUsersFirstResponses[channelID])
+		filtered.ChannelsUsersResponseTime[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsUsersResponseTime[channelID], a.ChannelsUsersResponseTime[channelID])
+		mergeCounts(filtered.UsersResponseTime, a.ChannelsUsersResponseTime[channelID])
+	}
+	// participants join threads whose first response was in another bucket
+	for channelID, nb := range a.ChannelsParticipants {
+		if keep(channelID) {
+			filtered.ChannelsParticipants[channelID] = nb
+		}
+	}
+	// posts of sources left out of other metrics are only counted here
+	for channelID, sources := range a.ChannelsSources {
+		if !keep(channelID) {
+			continue
+		}
+		filtered.ChannelsSources[channelID] = make(map[string]int64)
+		mergeCounts(filtered.ChannelsSources[channelID], sources)
+		mergeCounts(filtered.Sources, sources)
+	}
+	// users of a team are rebuilt from users of its kept channels
+	for teamID, channels := range a.TeamsChannels {
+		for channelID, nb := range channels {
+			if !keep(channelID) {
+				continue
+			}
+			filtered.Teams[teamID] += nb
+			addChannelUser(filtered.TeamsChannels, teamID, channelID, nb)
+			if _, ok := filtered.TeamsUsers[teamID]; !ok {
+				filtered.TeamsUsers[teamID] = make(map[string]int64)
+			}
+			mergeCounts(filtered.TeamsUsers[teamID], a.ChannelsUsers[channelID])
+		}
+	}
+	return filtered
+}
+
+func mergeCounts(into map[string]int64, from map[string]int64) {
+	for key, nb := range from {
+		into[key] += nb
+	}
+}
+
+func mergeBreakdowns(into map[string]map[string]int64, from map[string]map[string]int64) {
+	for key, counts := range from {
+		if _, ok := into[key]; !ok {
+			into[key] = make(map[string]int64)
+		}
+		mergeCounts(into[key], counts)
+	}
 }
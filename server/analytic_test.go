@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolloverAndMerge(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+	end := start.Add(bucketDuration)
+
+	current := NewAnalytic()
+	current.Start = start
+	current.Channels["chan1"] = 2
+	current.Users["user1"] = 2
+	incrementChannelUser(current.ChannelsUsers, "chan1", "user1")
+
+	closed := current.Rollover(end)
+	assert.Equal(start, closed.Start)
+	assert.Equal(end, closed.End)
+	assert.Equal(int64(2), closed.Channels["chan1"])
+	assert.Equal(int64(1), closed.ChannelsUsers["chan1"]["user1"])
+	assert.Equal(end, current.Start)
+	assert.True(current.End.IsZero())
+	assert.Empty(current.Channels)
+	assert.Empty(current.ChannelsUsers)
+
+	current.Channels["chan1"] = 3
+	current.Merge(closed)
+	assert.Equal(int64(5), current.Channels["chan1"])
+	assert.Equal(int64(2), current.Users["user1"])
+	assert.Equal(int64(1), current.ChannelsUsers["chan1"]["user1"])
+}
+
+func TestPeriod(t *testing.T) {
+	assert := assert.New(t)
+	since := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := since.AddDate(0, 1, 0)
+
+	pe := period{since: since, until: until}
+	assert.True(pe.contains(since))
+	assert.True(pe.contains(until.Add(-time.Hour)))
+	assert.False(pe.contains(until))
+	assert.False(pe.contains(since.Add(-time.Hour)))
+	assert.True(period{since: since}.contains(time.Now()))
+
+	pe = period{until: until}.withDefaultSince(defaultReportDuration)
+	assert.Equal(until.Add(-defaultReportDuration), pe.since)
+	assert.Equal(24*time.Hour, trendsStep(pe))
+	assert.Equal(7*24*time.Hour, trendsStep(trendsPeriod(pe)))
+}
+
+func TestHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	since := time.Date(2019, 3, 1, 0, 0, 0, 0, time.Local)
+	h := &history{buckets: make([]*Analytic, 0)}
+	for day, nb := range []int64{1, 2, 4} {
+		bucket := NewAnalytic()
+		bucket.Start = since.AddDate(0, 0, day)
+		bucket.End = bucket.Start.Add(time.Hour)
+		bucket.Channels["chan1"] = nb
+		h.buckets = append(h.buckets, bucket)
+	}
+
+	assert.Equal(int64(3), h.between(period{since: since, until: since.AddDate(0, 0, 2)}).Channels["chan1"])
+	assert.Equal(int64(6), h.between(period{since: since.AddDate(0, 0, 1)}).Channels["chan1"])
+	steps := h.byStep(period{since: since, until: since.AddDate(0, 0, 4)}, 48*time.Hour)
+	assert.Len(steps, 2)
+	assert.Equal(int64(3), steps[0].Channels["chan1"])
+	assert.Equal(int64(4), steps[1].Channels["chan1"])
+}
+
+func TestCachedBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &kvAPI{kv: map[string][]byte{}}
+	p := &Plugin{}
+	p.API = api
+	bucket := NewAnalytic()
+	bucket.Start = bucketStart(time.Now()).Add(-2 * bucketDuration)
+	bucket.End = bucket.Start.Add(bucketDuration)
+	bucket.Channels["chan1"] = 1
+	ref, err := p.saveBucket(bucket)
+	assert.Nil(err)
+
+	first, err := p.cachedBucket(ref)
+	assert.Nil(err)
+	second, err := p.cachedBucket(ref)
+	assert.Nil(err)
+	assert.True(first == second)
+
+	// a bucket written again is read again, its old copy is evicted
+	bucket.Channels["chan1"] = 2
+	saved, err := p.saveBucket(bucket)
+	assert.Nil(err)
+	third, err := p.cachedBucket(saved)
+	assert.Nil(err)
+	assert.Equal(int64(2), third.Channels["chan1"])
+	p.evictBuckets([]bucketRef{saved})
+	assert.Len(p.bucketsCache, 1)
+	p.evictBuckets(nil)
+	assert.Len(p.bucketsCache, 0)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	apiPrefix = "/api/v1/"
+	// apiDefaultPerPage and apiMaxPerPage follow the pagination of the mattermost api
+	apiDefaultPerPage = 60
+	apiMaxPerPage     = 200
+	// apiMaxPage keeps page * per_page in an int32
+	apiMaxPage = math.MaxInt32 / apiMaxPerPage
+)
+
+// apiSummary is the response of /api/v1/summary
+type apiSummary struct {
+	Since           time.Time `json:"since"`
+	Until           time.Time `json:"until"`
+	Users           int       `json:"users"`
+	Channels        int       `json:"channels"`
+	MessagesPublic  int64     `json:"messages_public"`
+	MessagesPrivate int64     `json:"messages_private"`
+	FilesNb         int64     `json:"files"`
+	FilesSize       int64     `json:"files_size"`
+}
+
+// apiLine is a channel or a user in /api/v1/channels, /api/v1/users and /api/v1/files
+// files lines have files and files_size instead of messages
+type apiLine struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Link        string `json:"link,omitempty"`
+	Messages    int64  `json:"messages"`
+	Replies     int64  `json:"replies"`
+	FilesNb     int64  `json:"files,omitempty"`
+	FilesSize   int64  `json:"files_size,omitempty"`
+}
+
+// apiPeriod is a step of /api/v1/periods
+type apiPeriod struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Messages  int64     `json:"messages"`
+	Replies   int64     `json:"replies"`
+	FilesNb   int64     `json:"files"`
+	FilesSize int64     `json:"files_size"`
+}
+
+// apiPage is a page of lines or periods
+type apiPage struct {
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int         `json:"total"`
+	Items   interface{} `json:"items"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiRequest is a parsed request of the api
+type apiRequest struct {
+	period  period
+	keep    func(channelID string) bool
+	page    int
+	perPage int
+}
+
+// serveAPI serve analytics as json, filtered by period, team and channel
+// users only get channels they are member of, unless they are system admins
+func (p *Plugin) serveAPI(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		p.writeAPIError(w, http.StatusUnauthorized, "Not authorized")
+		return
+	}
+	if r.Method != http.MethodGet {
+		p.writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	req, status, err := p.parseAPIRequest(userID, r.URL.Query())
+	if err != nil {
+		p.writeAPIError(w, status, err.Error())
+		return
+	}
+
+	var response interface{}
+	switch strings.TrimPrefix(r.URL.Path, apiPrefix) {
+	case "summary":
+		response, err = p.apiSummary(req)
+	case "channels":
+		response, err = p.apiChannels(req)
+	case "users":
+		if p.getConfiguration().AnonymizeUsers == anonymizeHidden {
+			p.writeAPIError(w, http.StatusForbidden, "User rankings are hidden")
+			return
+		}
+		response, err = p.apiUsers(req)
+	case "files":
+		response, err = p.apiFiles(req)
+	case "periods":
+		response, err = p.apiPeriods(req)
+	case "active_users":
+		response, err = p.apiActiveUsers(req)
+	default:
+		p.writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if err != nil {
+		p.API.LogError("can't build api response", "path", r.URL.Path, "err", err.Error())
+		p.writeAPIError(w, http.StatusInternalServerError, "An error occured")
+		return
+	}
+	p.writeJSON(w, http.StatusOK, response)
+}
+
+// parseAPIRequest read filters and pagination of a request and check the user can access them
+// since and until are dates like the flags of the command, team and channel are ids
+func (p *Plugin) parseAPIRequest(userID string, query url.Values) (*apiRequest, int, error) {
+	req := &apiRequest{page: 0, perPage: apiDefaultPerPage}
+	for _, name := range []string{"since", "until"} {
+		if value := query.Get(name); value != "" {
+			if err := setPeriodFlag(&req.period, name, value, p.getConfiguration().getReportLocation()); err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+		}
+	}
+	if err := checkPeriod(req.period); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	req.period = req.period.withDefaultSince(defaultReportDuration)
+
+	if value := query.Get("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 0 || page > apiMaxPage {
+			return nil, http.StatusBadRequest, fmt.Errorf("Bad page: %s", value)
+		}
+		req.page = page
+	}
+	if value := query.Get("per_page"); value != "" {
+		perPage, err := strconv.Atoi(value)
+		if err != nil || perPage <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("Bad per_page: %s", value)
+		}
+		if perPage > apiMaxPerPage {
+			perPage = apiMaxPerPage
+		}
+		req.perPage = perPage
+	}
+
+	isAdmin := p.API.HasPermissionTo(userID, model.PERMISSION_MANAGE_SYSTEM)
+	teamID := query.Get("team")
+	channelID := query.Get("channel")
+	if !isAdmin && teamID != "" {
+		if _, appErr := p.API.GetTeamMember(teamID, userID); appErr != nil {
+			return nil, http.StatusForbidden, errors.New("Not a member of this team")
+		}
+	}
+	if !isAdmin && channelID != "" {
+		if _, appErr := p.API.GetChannelMember(channelID, userID); appErr != nil {
+			return nil, http.StatusForbidden, errors.New("Not a member of this channel")
+		}
+	}
+
+	var member map[string]bool
+	if !isAdmin && channelID == "" {
+		channels, err := p.getMemberChannels(userID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		member = channels
+	}
+	req.keep = func(key string) bool {
+		if channelID != "" && key != channelID {
+			return false
+		}
+		if member != nil && !member[key] {
+			return false
+		}
+		if teamID != "" {
+			channelTeamID, err := p.getChannelTeamID(key)
+			if err != nil {
+				p.API.LogWarn("can't get team of channel", "channelID", key, "err", err.Error())
+				return false
+			}
+			return channelTeamID == teamID
+		}
+		return true
+	}
+	return req, http.StatusOK, nil
+}
+
+// getMemberChannels return ids of all channels of a user, direct messages included
+func (p *Plugin) getMemberChannels(userID string) (map[string]bool, error) {
+	teams, appErr := p.API.GetTeamsForUser(userID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get teams of user")
+	}
+	member := make(map[string]bool)
+	for _, team := range teams {
+		channels, appErr := p.API.GetChannelsForTeamForUser(team.Id, userID, false)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "can't get channels of user")
+		}
+		for _, channel := range channels {
+			member[channel.Id] = true
+		}
+	}
+	return member, nil
+}
+
+func (p *Plugin) apiAnalytic(req *apiRequest) *Analytic {
+	return p.analyticBetween(req.period).FilterChannels(req.keep)
+}
+
+func (p *Plugin) apiSummary(req *apiRequest) (*apiSummary, error) {
+	data, err := p.prepareData(p.apiAnalytic(req), nil)
+	if err != nil {
+		return nil, err
+	}
+	channels := 0
+	for _, channel := range data.channels {
+		if channel.nb > 0 || channel.reply > 0 {
+			channels++
+		}
+	}
+	return &apiSummary{
+		Since:           req.period.since,
+		Until:           req.period.end(),
+		Users:           data.totalUsers,
+		Channels:        channels,
+		MessagesPublic:  data.totalMessagesPublic,
+		MessagesPrivate: data.totalMessagesPrivate,
+		FilesNb:         data.filesNb,
+		FilesSize:       data.filesSize,
+	}, nil
+}
+
+func (p *Plugin) apiChannels(req *apiRequest) (*apiPage, error) {
+	data, err := p.prepareData(p.apiAnalytic(req), nil)
+	if err != nil {
+		return nil, err
+	}
+	return newAPIPage(req, toAPILines(data.channels, false)), nil
+}
+
+func (p *Plugin) apiUsers(req *apiRequest) (*apiPage, error) {
+	data, err := p.prepareData(p.apiAnalytic(req), nil)
+	if err != nil {
+		return nil, err
+	}
+	return newAPIPage(req, toAPILines(data.users, false)), nil
+}
+
+// apiFiles return channels with the number of files and their weight
+func (p *Plugin) apiFiles(req *apiRequest) (*apiPage, error) {
+	data, err := p.prepareFilesData(p.apiAnalytic(req), nil)
+	if err != nil {
+		return nil, err
+	}
+	return newAPIPage(req, toAPILines(data.channels, true)), nil
+}
+
+// apiPeriods return totals for each step of the period, like trends charts
+func (p *Plugin) apiPeriods(req *apiRequest) (*apiPage, error) {
+	periods := make([]apiPeriod, 0)
+	for _, step := range p.analyticsByStep(req.period, trendsStep(req.period)) {
+		filtered := step.FilterChannels(req.keep)
+		line := apiPeriod{Start: filtered.Start, End: filtered.End, FilesNb: filtered.FilesNb, FilesSize: filtered.FilesSize}
+		for channelID, nb := range filtered.Channels {
+			line.Messages += nb
+			line.Replies += filtered.ChannelsReply[channelID]
+		}
+		periods = append(periods, line)
+	}
+
+	page := &apiPage{Page: req.page, PerPage: req.perPage, Total: len(periods)}
+	start, end := pageBounds(req, len(periods))
+	page.Items = periods[start:end]
+	return page, nil
+}
+
+// apiActiveUsers return daily, weekly and monthly active users of each day of the period, not paginated
+func (p *Plugin) apiActiveUsers(req *apiRequest) (*activeUsers, error) {
+	location := p.getConfiguration().getReportLocation()
+	return getActiveUsers(p.loadHistory(activeUsersSince(req.period, location)), req.period, req.keep, location), nil
+}
+
+func toAPILines(data []analyticsData, files bool) []apiLine {
+	lines := make([]apiLine, 0, len(data))
+	for _, d := range data {
+		if d.nb == 0 && d.reply == 0 {
+			continue
+		}
+		line := apiLine{ID: d.id, Name: d.name, DisplayName: d.displayName, Link: d.link}
+		if files {
+			line.FilesNb = d.nb
+			line.FilesSize = d.size
+		} else {
+			line.Messages = d.nb
+			line.Replies = d.reply
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func newAPIPage(req *apiRequest, lines []apiLine) *apiPage {
+	start, end := pageBounds(req, len(lines))
+	return &apiPage{Page: req.page, PerPage: req.perPage, Total: len(lines), Items: lines[start:end]}
+}
+
+// pageBounds return the slice bounds of the requested page in a list of total items
+func pageBounds(req *apiRequest, total int) (int, int) {
+	if req.page > total/req.perPage {
+		return total, total
+	}
+	start := req.page * req.perPage
+	if start > total {
+		start = total
+	}
+	end := start + req.perPage
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+func (p *Plugin) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		p.API.LogError("can't write api response", "err", err.Error())
+	}
+}
+
+func (p *Plugin) writeAPIError(w http.ResponseWriter, status int, message string) {
+	p.writeJSON(w, status, apiError{Error: message})
+}
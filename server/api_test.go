@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageBounds(t *testing.T) {
+	assert := assert.New(t)
+
+	start, end := pageBounds(&apiRequest{page: 0, perPage: 60}, 10)
+	assert.Equal(0, start)
+	assert.Equal(10, end)
+
+	start, end = pageBounds(&apiRequest{page: 1, perPage: 4}, 10)
+	assert.Equal(4, start)
+	assert.Equal(8, end)
+
+	start, end = pageBounds(&apiRequest{page: 3, perPage: 4}, 10)
+	assert.Equal(10, start)
+	assert.Equal(10, end)
+
+	start, end = pageBounds(&apiRequest{page: math.MaxInt64 / 100, perPage: 200}, 10)
+	assert.Equal(10, start)
+	assert.Equal(10, end)
+}
+
+func TestParseAPIRequestPage(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Plugin{}
+	_, status, err := p.parseAPIRequest("user1", url.Values{"page": {strconv.Itoa(apiMaxPage + 1)}})
+	assert.Equal(http.StatusBadRequest, status)
+	assert.Error(err)
+	_, status, err = p.parseAPIRequest("user1", url.Values{"page": {"9223372036854775807"}})
+	assert.Equal(http.StatusBadRequest, status)
+	assert.Error(err)
+}
+
+func TestToAPILines(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []analyticsData{
+		{id: "none", name: "DM", displayName: "DM"},
+		{id: "chan1", name: "town-square", displayName: "Team/Town Square", nb: 3, reply: 1, size: 2000},
+	}
+	assert.Equal([]apiLine{{ID: "chan1", Name: "town-square", DisplayName: "Team/Town Square", Messages: 3, Replies: 1}}, toAPILines(data, false))
+	assert.Equal([]apiLine{{ID: "chan1", Name: "town-square", DisplayName: "Team/Town Square", FilesNb: 3, FilesSize: 2000}}, toAPILines(data, true))
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	backfillKey = "backfill"
+	// backfilledKey store periods of finished backfills, partials of these periods are dropped
+	backfilledKey = "backfilled"
+	// backfillPostsPerPage is the number of posts read at once in a channel
+	backfillPostsPerPage = 200
+	// backfillUsersPerPage is the number of users read at once in a team to find their channels
+	backfillUsersPerPage = 200
+	// backfillCheckpointChannels is the number of channels walked between two saves of the job
+	backfillCheckpointChannels = 20
+)
+
+// backfillJob is the state of a backfill, stored in kv so it can be resumed after a restart
+// posts between Since and Until are counted in hourly buckets staged until the job is done,
+// then they replace message counters of all buckets of this period, see replaceBackfilled
+type backfillJob struct {
+	Since time.Time
+	Until time.Time
+	// DailyUntil is the end of days old enough to be compacted by retention, their posts are staged by day
+	DailyUntil time.Time
+	// UserID and ChannelID are where the backfill was asked, to notify its end
+	UserID    string
+	ChannelID string
+	// NodeID is the node of a cluster running the backfill, only this one resumes it
+	NodeID string
+	// ChannelIDs are all channels to walk, Done the number of channels already walked
+	ChannelIDs []string
+	Done       int
+	Posts      int64
+	Staged     []bucketRef
+}
+
+// backfillRunner control the goroutine running a backfill job
+type backfillRunner struct {
+	lock sync.RWMutex
+	job  *backfillJob
+	stop chan struct{}
+	done chan struct{}
+}
+
+func stagedKey(ref bucketRef) string {
+	return fmt.Sprintf("backfill-%d-%d", ref.Start.Unix(), ref.End.Unix())
+}
+
+// startBackfill start a new backfill of all posts since since, only one backfill can run at once
+func (p *Plugin) startBackfill(userID string, channelID string, since time.Time) error {
+	p.backfillLock.Lock()
+	defer p.backfillLock.Unlock()
+
+	if p.backfill != nil {
+		return newCommandError("A backfill is already running, use `/analytics backfill status` to follow it")
+	}
+	job := &backfillJob{
+		Since:     since,
+		Until:     bucketStart(time.Now()),
+		UserID:    userID,
+		ChannelID: channelID,
+		NodeID:    p.nodeID,
+	}
+	if !job.Since.Before(job.Until) {
+		return newCommandError("--since must be in the past")
+	}
+	if days := p.getConfiguration().getCompactAfterDays(); days > 0 {
+		job.DailyUntil = dayStart(job.Until.AddDate(0, 0, -days))
+	}
+	if err := p.saveBackfillJob(job); err != nil {
+		return err
+	}
+	p.runBackfill(job)
+	return nil
+}
+
+// resumeBackfill restart the backfill stopped by the last deactivation, if any
+func (p *Plugin) resumeBackfill() error {
+	job, err := p.loadBackfillJob()
+	if err != nil || job == nil || job.NodeID != p.nodeID {
+		return err
+	}
+
+	p.backfillLock.Lock()
+	defer p.backfillLock.Unlock()
+	p.API.LogInfo("resume backfill", "since", job.Since.String(), "done", job.Done, "channels", len(job.ChannelIDs))
+	p.runBackfill(job)
+	return nil
+}
+
+// stopBackfill stop the running backfill, keeping its state to resume it later
+func (p *Plugin) stopBackfill() {
+	p.backfillLock.Lock()
+	runner := p.backfill
+	p.backfill = nil
+	p.backfillLock.Unlock()
+
+	if runner != nil {
+		close(runner.stop)
+		<-runner.done
+	}
+}
+
+// cancelBackfill stop the running backfill and delete all its state
+func (p *Plugin) cancelBackfill() error {
+	job, err := p.loadBackfillJob()
+	if err != nil {
+		return err
+	}
+	p.stopBackfill()
+	if job == nil {
+		return newCommandError("No backfill is running")
+	}
+	// reload the job, it was saved by the runner when stopped
+	if stopped, errL := p.loadBackfillJob(); errL == nil && stopped != nil {
+		job = stopped
+	}
+	p.deleteStagedBuckets(job)
+	if err := p.API.KVDelete(backfillKey); err != nil {
+		return errors.Wrap(err, "can't delete backfill")
+	}
+	return nil
+}
+
+// backfillStatus return a humanized progress of the running backfill
+func (p *Plugin) backfillStatus() string {
+	p.backfillLock.Lock()
+	runner := p.backfill
+	p.backfillLock.Unlock()
+	if runner == nil {
+		return "No backfill is running."
+	}
+
+	runner.lock.RLock()
+	defer runner.lock.RUnlock()
+	job := runner.job
+	if job.ChannelIDs == nil {
+		return fmt.Sprintf("Backfill since %s is looking for channels.", job.Since.Format("January 2, 2006"))
+	}
+	return fmt.Sprintf("Backfill since %s: **%d/%d** channels walked, **%d** posts counted.", job.Since.Format("January 2, 2006"), job.Done, len(job.ChannelIDs), job.Posts)
+}
+
+// runBackfill start the goroutine of a job, caller must hold backfillLock
+func (p *Plugin) runBackfill(job *backfillJob) {
+	runner := &backfillRunner{
+		job:  job,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	p.backfill = runner
+
+	go func() {
+		defer close(runner.done)
+		defer func() {
+			p.backfillLock.Lock()
+			if p.backfill == runner {
+				p.backfill = nil
+			}
+			p.backfillLock.Unlock()
+		}()
+
+		finished, err := p.walkBackfill(runner)
+		if err != nil {
+			p.API.LogError("backfill failed, it will resume on next activation", "err", err.Error())
+			p.notifyBackfill(job, "Backfill failed, it will resume on next activation, or use `/analytics backfill cancel`.")
+			return
+		}
+		if !finished {
+			return
+		}
+		if err := p.finishBackfill(job); err != nil {
+			p.API.LogError("can't finish backfill", "err", err.Error())
+			p.notifyBackfill(job, "Backfill failed while saving analytics, it will resume on next activation.")
+			return
+		}
+		p.notifyBackfill(job, fmt.Sprintf("Backfill done: **%d** posts counted in **%d** channels since %s.", job.Posts, len(job.ChannelIDs), job.Since.Format("January 2, 2006")))
+	}()
+}
+
+// walkBackfill count posts of all channels of the job, it returns false if it was stopped before the end
+func (p *Plugin) walkBackfill(runner *backfillRunner) (bool, error) {
+	job := runner.job
+	if job.ChannelIDs == nil {
+		channelIDs, err := p.listAllChannels()
+		if err != nil {
+			return false, err
+		}
+		runner.lock.Lock()
+		job.ChannelIDs = channelIDs
+		runner.lock.Unlock()
+		if err := p.saveBackfillJob(job); err != nil {
+			return false, err
+		}
+	}
+
+	staged, err := p.loadStagedBuckets(job)
+	if err != nil {
+		return false, err
+	}
+	dirty := make(map[time.Time]bool)
+
+	for job.Done < len(job.ChannelIDs) {
+		select {
+		case <-runner.stop:
+			return false, p.checkpointBackfill(runner, staged, dirty)
+		default:
+		}
+
+		counted, posts, stopped, err := p.backfillChannel(job, job.ChannelIDs[job.Done], runner.stop)
+		if err != nil {
+			return false, err
+		}
+		if stopped {
+			return false, p.checkpointBackfill(runner, staged, dirty)
+		}
+		mergeStaged(staged, counted, dirty)
+		runner.lock.Lock()
+		job.Posts += posts
+		job.Done++
+		runner.lock.Unlock()
+
+		if job.Done%backfillCheckpointChannels == 0 {
+			if err := p.checkpointBackfill(runner, staged, dirty); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, p.checkpointBackfill(runner, staged, dirty)
+}
+
+// backfillChannel count all posts of a channel in the job period, newest first
+// it returns buckets to merge in staged ones once the whole channel is walked,
+// so a channel stopped in the middle is walked again on resume without counting twice
+func (p *Plugin) backfillChannel(job *backfillJob, channelID string, stop chan struct{}) (map[time.Time]*Analytic, int64, bool, error) {
+	counted := make(map[time.Time]*Analytic)
+	nb := int64(0)
+	teamID, err := p.getChannelTeamID(channelID)
+	if err != nil {
+		p.API.LogWarn("can't get team of channel, posts not counted in its team", "channelID", channelID, "err", err.Error())
+	}
+	for page := 0; ; page++ {
+		select {
+		case <-stop:
+			return nil, 0, true, nil
+		default:
+		}
+
+		list, appErr := p.API.GetPostsForChannel(channelID, page, backfillPostsPerPage)
+		if appErr != nil {
+			return nil, 0, false, errors.Wrap(appErr, "can't get posts of channel "+channelID)
+		}
+		for _, postID := range list.Order {
+			post := list.Posts[postID]
+			created := time.Unix(0, post.CreateAt*int64(time.Millisecond))
+			if created.Before(job.Since) {
+				return counted, nb, false, nil
+			}
+			if !created.Before(job.Until) {
+				continue
+			}
+			bucket := stagedBucket(counted, job, created)
+			source := p.getPostSource(post)
+			countSource(bucket, post, source)
+			nb++
+			if !p.getConfiguration().isCounted(source) {
+				continue
+			}
+			filesSize := p.getFilesSize(post.FileIds)
+			countPost(bucket, post, filesSize)
+			countTeam(bucket, post, teamID, 1)
+			countHeatmap(bucket, post, p.getConfiguration().getHeatmapLocation())
+			bucket.FilesNb += int64(len(post.FileIds))
+			bucket.FilesSize += filesSize
+		}
+		if len(list.Order) < backfillPostsPerPage {
+			return counted, nb, false, nil
+		}
+	}
+}
+
+// stagedStart return the start of the staged bucket containing t, the hour or the day before DailyUntil
+// like buckets compacted by retention
+func (job *backfillJob) stagedStart(t time.Time) time.Time {
+	if t.Before(job.DailyUntil) {
+		return dayStart(t)
+	}
+	return bucketStart(t)
+}
+
+// stagedBucket return the bucket of a backfill containing t, creating it if needed
+func stagedBucket(buckets map[time.Time]*Analytic, job *backfillJob, t time.Time) *Analytic {
+	start := job.stagedStart(t)
+	if bucket, ok := buckets[start]; ok {
+		return bucket
+	}
+	bucket := NewAnalytic()
+	bucket.Start = start
+	bucket.End = start.Add(bucketDuration)
+	if start.Before(job.DailyUntil) {
+		bucket.End = start.AddDate(0, 0, 1)
+	}
+	if start.Before(job.Since) {
+		bucket.Start = job.Since
+	}
+	if bucket.End.After(job.Until) {
+		bucket.End = job.Until
+	}
+	buckets[start] = bucket
+	return bucket
+}
+
+// replaceBackfilled return a bucket with messages, files, sources, teams and heatmap counters of staged,
+// the ones backfill recomputes, and all other metrics of live
+func replaceBackfilled(staged *Analytic, live *Analytic) *Analytic {
+	bucket := NewAnalytic()
+	bucket.Start = staged.Start
+	bucket.End = staged.End
+	if live.Start.Before(bucket.Start) {
+		bucket.Start = live.Start
+	}
+	if live.End.After(bucket.End) {
+		bucket.End = live.End
+	}
+	bucket.Merge(live)
+
+	recomputed := NewAnalytic()
+	bucket.Channels = recomputed.Channels
+	bucket.ChannelsReply = recomputed.ChannelsReply
+	bucket.Users = recomputed.Users
+	bucket.UsersReply = recomputed.UsersReply
+	bucket.FilesNb = 0
+	bucket.FilesSize = 0
+	bucket.ChannelsUsers = recomputed.ChannelsUsers
+	bucket.ChannelsUsersReply = recomputed.ChannelsUsersReply
+	bucket.ChannelsFilesNb = recomputed.ChannelsFilesNb
+	bucket.ChannelsFilesSize = recomputed.ChannelsFilesSize
+	bucket.UsersFilesNb = recomputed.UsersFilesNb
+	bucket.UsersFilesSize = recomputed.UsersFilesSize
+	bucket.ChannelsUsersFilesNb = recomputed.ChannelsUsersFilesNb
+	bucket.ChannelsUsersFilesSize = recomputed.ChannelsUsersFilesSize
+	bucket.Heatmap = recomputed.Heatmap
+	bucket.ChannelsHeatmap = recomputed.ChannelsHeatmap
+	bucket.Sources = recomputed.Sources
+	bucket.ChannelsSources = recomputed.ChannelsSources
+	bucket.Teams = recomputed.Teams
+	bucket.TeamsChannels = recomputed.TeamsChannels
+	bucket.TeamsUsers = recomputed.TeamsUsers
+
+	bucket.Merge(staged)
+	return bucket
+}
+
+// mergeStaged merge buckets counted in a channel in staged ones and mark them dirty
+func mergeStaged(staged map[time.Time]*Analytic, counted map[time.Time]*Analytic, dirty map[time.Time]bool) {
+	for start, bucket := range counted {
+		dirty[start] = true
+		if existing, ok := staged[start]; ok {
+			existing.Merge(bucket)
+		} else {
+			staged[start] = bucket
+		}
+	}
+}
+
+// listAllChannels return ids of all channels of all teams, direct and group messages included
+// there is no api to list private channels, so they are found through channels of each team member
+func (p *Plugin) listAllChannels() ([]string, error) {
+	teams, appErr := p.API.GetTeams()
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get teams")
+	}
+
+	found := make(map[string]bool)
+	channelIDs := make([]string, 0)
+	for _, team := range teams {
+		for page := 0; ; page++ {
+			users, appErr := p.API.GetUsersInTeam(team.Id, page, backfillUsersPerPage)
+			if appErr != nil {
+				return nil, errors.Wrap(appErr, "can't get users of team "+team.Name)
+			}
+			for _, user := range users {
+				channels, appErr := p.API.GetChannelsForTeamForUser(team.Id, user.Id, true)
+				if appErr != nil {
+					return nil, errors.Wrap(appErr, "can't get channels of user "+user.Id)
+				}
+				for _, channel := range channels {
+					if !found[channel.Id] {
+						found[channel.Id] = true
+						channelIDs = append(channelIDs, channel.Id)
+					}
+				}
+			}
+			if len(users) < backfillUsersPerPage {
+				break
+			}
+		}
+	}
+	return channelIDs, nil
+}
+
+// checkpointBackfill save staged buckets changed since the last checkpoint and the job, so it can be resumed from here
+func (p *Plugin) checkpointBackfill(runner *backfillRunner, staged map[time.Time]*Analytic, dirty map[time.Time]bool) error {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+
+	job := runner.job
+	refs := make([]bucketRef, 0, len(staged))
+	for start, bucket := range staged {
+		ref := bucketRef{Start: bucket.Start, End: bucket.End}
+		refs = append(refs, ref)
+		if !dirty[start] {
+			continue
+		}
+		j, err := encodeAnalytic(bucket)
+		if err != nil {
+			return errors.Wrap(err, "can't marshal staged bucket")
+		}
+		if err := p.API.KVSet(stagedKey(ref), j); err != nil {
+			return errors.Wrap(err, "can't save staged bucket")
+		}
+		delete(dirty, start)
+	}
+	job.Staged = refs
+	return p.saveBackfillJob(job)
+}
+
+func (p *Plugin) loadStagedBuckets(job *backfillJob) (map[time.Time]*Analytic, error) {
+	staged := make(map[time.Time]*Analytic)
+	for _, ref := range job.Staged {
+		j, err := p.API.KVGet(stagedKey(ref))
+		if err != nil {
+			return nil, errors.Wrap(err, "can't get staged bucket")
+		}
+		bucket, errD := p.decodeOrQuarantine(stagedKey(ref), j)
+		if errD != nil {
+			return nil, errD
+		}
+		staged[job.stagedStart(bucket.Start)] = bucket
+	}
+	return staged, nil
+}
+
+func (p *Plugin) deleteStagedBuckets(job *backfillJob) {
+	for _, ref := range job.Staged {
+		if err := p.API.KVDelete(stagedKey(ref)); err != nil {
+			p.API.LogWarn("can't delete staged bucket", "key", stagedKey(ref), "err", err.Error())
+		}
+	}
+}
+
+// finishBackfill replace all buckets of the job period by staged buckets, keeping metrics backfill doesn't count
+// partials of the period are merged first, so posts counted live and not merged yet are not counted twice,
+// the period is recorded so partials of it saved later, by nodes which closed their bucket late, are dropped
+func (p *Plugin) finishBackfill(job *backfillJob) error {
+	p.historyLock.Lock()
+	defer p.historyLock.Unlock()
+
+	pe := period{since: job.Since, until: job.Until}
+	if err := p.foldPartials(pe.contains); err != nil {
+		return err
+	}
+	backfilled, err := p.loadBackfilled()
+	if err != nil {
+		return err
+	}
+	if err := p.saveBackfilled(append(backfilled, bucketRef{Start: job.Since, End: job.Until})); err != nil {
+		return err
+	}
+	index, err := p.bucketsIndex()
+	if err != nil {
+		return err
+	}
+	staged, err := p.loadStagedBuckets(job)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]bucketRef, 0, len(index))
+	replaced := make([]bucketRef, 0)
+	for _, ref := range index {
+		if !pe.contains(ref.Start) {
+			kept = append(kept, ref)
+			continue
+		}
+		replaced = append(replaced, ref)
+		live, err := p.loadBucket(ref)
+		if err != nil {
+			p.API.LogWarn("can't load replaced bucket, only backfilled metrics are kept", "key", ref.key(), "err", err.Error())
+			continue
+		}
+		bucket := stagedBucket(staged, job, live.Start)
+		staged[job.stagedStart(live.Start)] = replaceBackfilled(bucket, live)
+	}
+
+	saved := make(map[string]bool)
+	for _, bucket := range staged {
+		ref, err := p.saveBucket(bucket)
+		if err != nil {
+			return err
+		}
+		kept = append(kept, ref)
+		saved[ref.key()] = true
+	}
+	if err := p.saveBucketsIndex(kept); err != nil {
+		return err
+	}
+
+	for _, ref := range replaced {
+		if saved[ref.key()] {
+			continue
+		}
+		if err := p.API.KVDelete(ref.key()); err != nil {
+			p.API.LogWarn("can't delete replaced bucket", "key", ref.key(), "err", err.Error())
+		}
+	}
+	p.deleteStagedBuckets(job)
+	if err := p.API.KVDelete(backfillKey); err != nil {
+		return errors.Wrap(err, "can't delete backfill")
+	}
+	return nil
+}
+
+// loadBackfilled return periods of finished backfills
+func (p *Plugin) loadBackfilled() ([]bucketRef, error) {
+	backfilled := make([]bucketRef, 0)
+	j, err := p.API.KVGet(backfilledKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get backfilled periods")
+	}
+	if len(j) == 0 {
+		return backfilled, nil
+	}
+	if err := json.Unmarshal(j, &backfilled); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal backfilled periods")
+	}
+	return backfilled, nil
+}
+
+func (p *Plugin) saveBackfilled(backfilled []bucketRef) error {
+	j, err := json.Marshal(backfilled)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal backfilled periods")
+	}
+	if err := p.API.KVSet(backfilledKey, j); err != nil {
+		return errors.Wrap(err, "can't save backfilled periods")
+	}
+	return nil
+}
+
+// isBackfilled return true if t is in the period of a finished backfill
+func isBackfilled(backfilled []bucketRef, t time.Time) bool {
+	for _, ref := range backfilled {
+		if !t.Before(ref.Start) && t.Before(ref.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plugin) notifyBackfill(job *backfillJob, message string) {
+	p.API.SendEphemeralPost(job.UserID, &model.Post{
+		UserId:    p.BotUserID,
+		ChannelId: job.ChannelID,
+		Message:   message,
+	})
+}
+
+func (p *Plugin) loadBackfillJob() (*backfillJob, error) {
+	j, err := p.API.KVGet(backfillKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get backfill")
+	}
+	if len(j) == 0 {
+		return nil, nil
+	}
+	job := &backfillJob{}
+	if err := json.Unmarshal(j, job); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal backfill")
+	}
+	return job, nil
+}
+
+func (p *Plugin) saveBackfillJob(job *backfillJob) error {
+	j, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal backfill")
+	}
+	if err := p.API.KVSet(backfillKey, j); err != nil {
+		return errors.Wrap(err, "can't save backfill")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStagedBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	job := &backfillJob{
+		Since:      time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC),
+		Until:      time.Date(2019, 3, 2, 15, 0, 0, 0, time.UTC),
+		DailyUntil: time.Date(2019, 3, 2, 0, 0, 0, 0, time.UTC),
+	}
+	staged := make(map[time.Time]*Analytic)
+	counted := make(map[time.Time]*Analytic)
+	dirty := make(map[time.Time]bool)
+
+	// days old enough to be compacted are staged by day, others by hour
+	first := stagedBucket(counted, job, time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC))
+	assert.Equal(job.Since, first.Start)
+	assert.Equal(time.Date(2019, 3, 2, 0, 0, 0, 0, time.UTC), first.End)
+	assert.True(first == stagedBucket(counted, job, time.Date(2019, 3, 1, 23, 0, 0, 0, time.UTC)))
+
+	last := stagedBucket(counted, job, time.Date(2019, 3, 2, 14, 30, 0, 0, time.UTC))
+	assert.Equal(time.Date(2019, 3, 2, 14, 0, 0, 0, time.UTC), last.Start)
+	assert.Equal(job.Until, last.End)
+	last.Users["user1"] = 2
+
+	mergeStaged(staged, counted, dirty)
+	assert.Len(dirty, 2)
+	other := map[time.Time]*Analytic{}
+	stagedBucket(other, job, time.Date(2019, 3, 2, 14, 10, 0, 0, time.UTC)).Users["user1"] = 3
+	mergeStaged(staged, other, dirty)
+	assert.Len(staged, 2)
+	assert.Equal(int64(5), staged[time.Date(2019, 3, 2, 14, 0, 0, 0, time.UTC)].Users["user1"])
+
+	backfilled := []bucketRef{{Start: job.Since, End: job.Until}}
+	assert.True(isBackfilled(backfilled, job.Since))
+	assert.False(isBackfilled(backfilled, job.Until))
+}
+
+func TestReplaceBackfilled(t *testing.T) {
+	assert := assert.New(t)
+
+	day := time.Date(2019, 3, 1, 0, 0, 0, 0, time.Local)
+	live := NewAnalytic()
+	live.Start = day.Add(10 * time.Hour)
+	live.End = day.Add(11 * time.Hour)
+	live.Channels["chan1"] = 3
+	live.Users["user1"] = 3
+	live.FilesNb = 1
+	live.ReactionsGiven["user2"] = 4
+	live.ChannelsReactions["chan1"] = 4
+	live.UsersEdits["user1"] = 1
+
+	staged := NewAnalytic()
+	staged.Start = day
+	staged.End = day.AddDate(0, 0, 1)
+	staged.Channels["chan1"] = 5
+	staged.Users["user1"] = 5
+	staged.FilesNb = 2
+
+	bucket := replaceBackfilled(staged, live)
+	assert.Equal(day, bucket.Start)
+	assert.Equal(day.AddDate(0, 0, 1), bucket.End)
+	assert.Equal(int64(5), bucket.Channels["chan1"])
+	assert.Equal(int64(5), bucket.Users["user1"])
+	assert.Equal(int64(2), bucket.FilesNb)
+	assert.Equal(int64(4), bucket.ReactionsGiven["user2"])
+	assert.Equal(int64(4), bucket.ChannelsReactions["chan1"])
+	assert.Equal(int64(1), bucket.UsersEdits["user1"])
+	assert.Equal(int64(3), live.Channels["chan1"])
+}
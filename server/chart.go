@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+	chart "github.com/wcharczuk/go-chart"
+)
+
+const (
+	chartPrefix    = "/chart/"
+	chartKeyPrefix = "chart-"
+	pieChart       = "pie"
+	barChart       = "bar"
+	lineChart      = "line"
+)
+
+// chartSpec is all data needed to draw a chart of a report, stored in kv under an opaque id
+// so that urls stay short and charts can't be drawn with any data
+type chartSpec struct {
+	Kind string
+	// Labels and Values are the data of pie and bar charts
+	Labels []string
+	Values []float64
+	// Dates and Series are the data of line charts, each series has a value by date
+	Dates  []int64
+	Series []chartSeries
+}
+
+// chartSeries is a line of a line chart
+type chartSeries struct {
+	Name   string
+	Values []float64
+}
+
+func chartKey(id string) string {
+	return chartKeyPrefix + id
+}
+
+// saveChart store a chart spec and return the url to draw it
+// specs expire after ChartsExpiryDays and are deleted by mattermost, charts of older reports are then not displayed anymore
+func (p *Plugin) saveChart(siteURL string, spec *chartSpec) (string, error) {
+	j, err := json.Marshal(spec)
+	if err != nil {
+		return "", errors.Wrap(err, "can't marshal chart")
+	}
+	id := model.NewId()
+	expiry := int64(p.getConfiguration().getChartsExpiryDays()) * int64(24*time.Hour/time.Second)
+	if err := p.API.KVSetWithExpiry(chartKey(id), j, expiry); err != nil {
+		return "", errors.Wrap(err, "can't save chart")
+	}
+	return siteURL + "/plugins/com.github.manland.mattermost-plugin-analytics" + chartPrefix + id + "." + p.getConfiguration().getChartsFormat(), nil
+}
+
+// handleChart draw a chart stored by saveChart, the url is /chart/<id>.svg or /chart/<id>.png
+func (p *Plugin) handleChart(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, chartPrefix)
+	id = strings.TrimSuffix(id, path.Ext(id))
+	if !model.IsValidId(id) {
+		http.NotFound(w, r)
+		return
+	}
+	j, appErr := p.API.KVGet(chartKey(id))
+	if appErr != nil {
+		p.API.LogError("can't get chart", "id", id, "err", appErr.Error())
+		http.Error(w, "An error occured", http.StatusInternalServerError)
+		return
+	}
+	if len(j) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	spec := &chartSpec{}
+	if err := json.Unmarshal(j, spec); err != nil {
+		p.API.LogError("can't unmarshal chart", "id", id, "err", err.Error())
+		http.Error(w, "An error occured", http.StatusInternalServerError)
+		return
+	}
+
+	format := p.getChartFormat(r)
+	var err error
+	switch spec.Kind {
+	case pieChart:
+		err = p.renderPie(w, format, spec.chartValues())
+	case barChart:
+		err = p.renderBar(w, format, spec.chartValues())
+	case heatmapChart:
+		err = p.renderHeatmap(w, format, spec.Values)
+	case lineChart:
+		times := make([]time.Time, 0, len(spec.Dates))
+		for _, date := range spec.Dates {
+			times = append(times, time.Unix(date, 0))
+		}
+		err = p.renderLine(w, format, times, spec.Series)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		p.API.LogError("Error rendering chart", "id", id, "err", err.Error())
+	}
+}
+
+// chartFormat is the image format and size of a chart
+type chartFormat struct {
+	provider    chart.RendererProvider
+	contentType string
+	// scale multiply the size of charts
+	scale float64
+	// dpi is 0 to use the default one of go-chart
+	dpi float64
+}
+
+// getChartFormat choose svg or png from the extension of the url or else the Accept header
+// png charts are drawn with more pixels on devices with a pixel ratio higher than 1
+func (p *Plugin) getChartFormat(r *http.Request) chartFormat {
+	config := p.getConfiguration()
+	svg := chartFormat{provider: chart.SVG, contentType: chart.ContentTypeSVG, scale: config.getChartsScale()}
+	png := chartFormat{provider: chart.PNG, contentType: chart.ContentTypePNG, scale: config.getChartsScale() * config.getChartsPixelRatio()}
+	png.dpi = chart.DefaultDPI * config.getChartsPixelRatio()
+
+	switch path.Ext(r.URL.Path) {
+	case ".png":
+		return png
+	case ".svg":
+		return svg
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, chart.ContentTypePNG) && !strings.Contains(accept, chart.ContentTypeSVG) {
+		return png
+	}
+	return svg
+}
+
+// size return the size of a chart drawn in this format
+func (f chartFormat) size(width int, height int) (int, int) {
+	return int(float64(width) * f.scale), int(float64(height) * f.scale)
+}
+
+func (spec *chartSpec) chartValues() []chart.Value {
+	values := make([]chart.Value, 0, len(spec.Labels))
+	for index, label := range spec.Labels {
+		if index < len(spec.Values) {
+			values = append(values, chart.Value{Label: label, Value: spec.Values[index]})
+		}
+	}
+	return values
+}
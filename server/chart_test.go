@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	chart "github.com/wcharczuk/go-chart"
+)
+
+func TestTopChartSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := []analyticsData{
+		{id: "chan1", displayName: "Team/Chan1", nb: 5},
+		{id: "chan2", displayName: "Team/Chan2", nb: 3},
+		{id: "chan3", displayName: "Team/Chan3", nb: 1},
+	}
+	spec := topChartSpec(pieChart, lines, 1)
+	assert.Equal(&chartSpec{Kind: pieChart, Labels: []string{"Team/Chan1", "Team/Chan2"}, Values: []float64{5, 3}}, spec)
+	assert.Equal([]chart.Value{{Label: "Team/Chan1", Value: 5}, {Label: "Team/Chan2", Value: 3}}, spec.chartValues())
+}
+
+func TestGetChartFormat(t *testing.T) {
+	assert := assert.New(t)
+	p := &Plugin{configuration: &configuration{ChartsScale: "1.5", ChartsPixelRatio: "2"}}
+
+	format := p.getChartFormat(httptest.NewRequest("GET", "/chart/id.svg", nil))
+	assert.Equal(chart.ContentTypeSVG, format.contentType)
+	width, height := format.size(300, 200)
+	assert.Equal(450, width)
+	assert.Equal(300, height)
+
+	format = p.getChartFormat(httptest.NewRequest("GET", "/chart/id.png", nil))
+	assert.Equal(chart.ContentTypePNG, format.contentType)
+	assert.Equal(2*chart.DefaultDPI, format.dpi)
+	width, _ = format.size(300, 200)
+	assert.Equal(900, width)
+
+	r := httptest.NewRequest("GET", "/chart/id", nil)
+	r.Header.Set("Accept", "image/png,image/*")
+	assert.Equal(chart.ContentTypePNG, p.getChartFormat(r).contentType)
+	r.Header.Set("Accept", "image/svg+xml,image/png")
+	assert.Equal(chart.ContentTypeSVG, p.getChartFormat(r).contentType)
+}
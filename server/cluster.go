@@ -0,0 +1,494 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+// In a high availability cluster, each node runs its own instance of this plugin
+// with its own current bucket. Each node saves its current bucket under its own key
+// and closes it in a partial bucket, partials of all nodes are merged in closed buckets
+// by the leader. Reports merge at read time what is not merged yet, they find it through
+// the registry of nodes and the index of partials of each node, kv is never listed.
+const (
+	nodeCurrentPrefix  = "analytics-node-"
+	partialPrefix      = "partial-"
+	nodesKey           = "nodes"
+	openPartialsPrefix = "openPartials-"
+	heartbeatPrefix    = "heartbeat-"
+	leaderKey          = "leader"
+	// heartbeatSeconds is how long a node is considered running after its last heartbeat
+	heartbeatSeconds = 10 * 60
+	// leaderLockSeconds is how long the leader keeps the lock without renewing it
+	leaderLockSeconds = 3 * 60
+	kvListPerPage     = 200
+	sentRunPrefix     = "sent-"
+	// sentRunSeconds is how long a sent report is remembered, longer than nodes can be late on each other
+	sentRunSeconds = 2 * 24 * 60 * 60
+)
+
+// claimDelay is how long a node waits after writing a claim before reading it back,
+// nodes which wrote the same key in this delay all read the id of the last writer
+var claimDelay = 2 * time.Second
+
+// getNodeID return an id of this node, stable across restarts so a node finds back its current bucket
+// it's short enough to fit in kv keys
+func getNodeID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return model.NewId()[:8]
+	}
+	sum := sha1.Sum([]byte(hostname))
+	return fmt.Sprintf("%x", sum[:4])
+}
+
+func (p *Plugin) nodeCurrentKey() string {
+	return nodeCurrentPrefix + p.nodeID
+}
+
+func (p *Plugin) partialKey(bucket *Analytic) string {
+	return fmt.Sprintf("%s%s-%d", partialPrefix, p.nodeID, bucket.Start.Unix())
+}
+
+func (p *Plugin) savePartial(bucket *Analytic) error {
+	j, err := encodeAnalytic(bucket)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal partial")
+	}
+	if err := p.API.KVSet(p.partialKey(bucket), j); err != nil {
+		return errors.Wrap(err, "can't save partial")
+	}
+	if err := p.indexPartial(p.partialKey(bucket)); err != nil {
+		p.API.LogError("can't index partial, it will be indexed with the next one", "err", err.Error())
+	}
+	return nil
+}
+
+func (p *Plugin) loadKeyList(key string) ([]string, error) {
+	keys := make([]string, 0)
+	j, err := p.API.KVGet(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get "+key)
+	}
+	if len(j) == 0 {
+		return keys, nil
+	}
+	if err := json.Unmarshal(j, &keys); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal "+key)
+	}
+	return keys, nil
+}
+
+func (p *Plugin) saveKeyList(key string, keys []string) error {
+	j, err := json.Marshal(keys)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal "+key)
+	}
+	if err := p.API.KVSet(key, j); err != nil {
+		return errors.Wrap(err, "can't save "+key)
+	}
+	return nil
+}
+
+// registerNode add this node to the registry of nodes, called on activation and each hour
+// so a registration lost by concurrent writes of two nodes is written back
+func (p *Plugin) registerNode() error {
+	nodes, err := p.loadKeyList(nodesKey)
+	if err != nil {
+		return err
+	}
+	for _, nodeID := range nodes {
+		if nodeID == p.nodeID {
+			return nil
+		}
+	}
+	return p.saveKeyList(nodesKey, append(nodes, p.nodeID))
+}
+
+// heartbeat tell other nodes this node is running, called on activation and each minute
+// current buckets of nodes without heartbeat are merged by the leader
+func (p *Plugin) heartbeat() error {
+	if err := p.API.KVSetWithExpiry(heartbeatPrefix+p.nodeID, []byte(p.nodeID), heartbeatSeconds); err != nil {
+		return errors.Wrap(err, "can't save heartbeat")
+	}
+	return nil
+}
+
+// isRunning return true if a node sent a heartbeat in the last heartbeatSeconds
+func (p *Plugin) isRunning(nodeID string) (bool, error) {
+	j, err := p.API.KVGet(heartbeatPrefix + nodeID)
+	if err != nil {
+		return false, errors.Wrap(err, "can't get heartbeat")
+	}
+	return len(j) > 0, nil
+}
+
+// indexPartial add a partial of this node to its index, only this node writes its index
+// partials merged by the leader are removed from the index when a new one is added
+func (p *Plugin) indexPartial(key string) error {
+	p.partialsLock.Lock()
+	defer p.partialsLock.Unlock()
+
+	p.unindexedPartials = append(p.unindexedPartials, key)
+	indexKey := openPartialsPrefix + p.nodeID
+	keys, err := p.loadKeyList(indexKey)
+	if err != nil {
+		return err
+	}
+	open := make([]string, 0, len(keys)+len(p.unindexedPartials))
+	found := make(map[string]bool)
+	for _, indexed := range keys {
+		j, err := p.API.KVGet(indexed)
+		if err != nil {
+			return errors.Wrap(err, "can't get partial")
+		}
+		if len(j) > 0 {
+			open = append(open, indexed)
+			found[indexed] = true
+		}
+	}
+	for _, unindexed := range p.unindexedPartials {
+		if !found[unindexed] {
+			open = append(open, unindexed)
+			found[unindexed] = true
+		}
+	}
+	if err := p.saveKeyList(indexKey, open); err != nil {
+		return err
+	}
+	p.unindexedPartials = nil
+	return nil
+}
+
+// indexOwnPartials rebuild the index of partials of this node from all keys, called once on activation
+// to find partials saved before the index existed
+func (p *Plugin) indexOwnPartials() error {
+	p.partialsLock.Lock()
+	defer p.partialsLock.Unlock()
+
+	prefix := fmt.Sprintf("%s%s-", partialPrefix, p.nodeID)
+	keys, err := p.listKeys(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+	if err != nil {
+		return err
+	}
+	return p.saveKeyList(openPartialsPrefix+p.nodeID, keys)
+}
+
+// openKeys return keys of buckets not merged in closed buckets yet: partials of all nodes
+// and current buckets of other nodes, some of them may be already merged and empty
+func (p *Plugin) openKeys() ([]string, error) {
+	nodes, err := p.loadKeyList(nodesKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{currentAnalyticKey}
+	for _, nodeID := range nodes {
+		if nodeID != p.nodeID {
+			keys = append(keys, nodeCurrentPrefix+nodeID)
+		}
+		partials, err := p.loadKeyList(openPartialsPrefix + nodeID)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, partials...)
+	}
+	return keys, nil
+}
+
+// forgetNode remove a stopped node from the registry once all its partials are merged
+// it registers again if it restarts
+func (p *Plugin) forgetNode(nodeID string) {
+	indexKey := openPartialsPrefix + nodeID
+	partials, err := p.loadKeyList(indexKey)
+	if err != nil {
+		p.API.LogWarn("can't get partials of stopped node", "nodeID", nodeID, "err", err.Error())
+		return
+	}
+	for _, key := range partials {
+		if j, err := p.API.KVGet(key); err != nil || len(j) > 0 {
+			return
+		}
+	}
+
+	nodes, err := p.loadKeyList(nodesKey)
+	if err != nil {
+		p.API.LogWarn("can't get nodes", "err", err.Error())
+		return
+	}
+	kept := make([]string, 0, len(nodes))
+	for _, id := range nodes {
+		if id != nodeID {
+			kept = append(kept, id)
+		}
+	}
+	if err := p.saveKeyList(nodesKey, kept); err != nil {
+		p.API.LogWarn("can't save nodes", "err", err.Error())
+		return
+	}
+	if err := p.API.KVDelete(indexKey); err != nil {
+		p.API.LogWarn("can't delete partials index", "key", indexKey, "err", err.Error())
+	}
+}
+
+// isNodeCurrentKey return true for current buckets of all nodes
+// currentAnalyticKey is the current bucket stored before nodes had their own key
+func isNodeCurrentKey(key string) bool {
+	return key == currentAnalyticKey || strings.HasPrefix(key, nodeCurrentPrefix)
+}
+
+func isPartialKey(key string) bool {
+	return strings.HasPrefix(key, partialPrefix)
+}
+
+// claimKey write the id of this node in an empty key and return true if it still reads it after claimDelay
+// mattermost before 5.12 has no compare and set, when nodes claim a key at the same time
+// only the last writer reads back its own id. It's best effort: a node writing after another one read back
+// its id also wins, so two nodes can rarely both lead or send the same report
+func (p *Plugin) claimKey(key string, expireInSeconds int64) (bool, error) {
+	j, err := p.API.KVGet(key)
+	if err != nil {
+		return false, errors.Wrap(err, "can't get claim")
+	}
+	if len(j) > 0 {
+		return string(j) == p.nodeID, nil
+	}
+	if err := p.API.KVSetWithExpiry(key, []byte(p.nodeID), expireInSeconds); err != nil {
+		return false, errors.Wrap(err, "can't set claim")
+	}
+	time.Sleep(claimDelay)
+	j, err = p.API.KVGet(key)
+	if err != nil {
+		return false, errors.Wrap(err, "can't get claim")
+	}
+	return string(j) == p.nodeID, nil
+}
+
+// acquireLeadership take or renew the leader lock, it returns true if this node is the leader
+// only the leader sends scheduled reports and changes closed buckets
+func (p *Plugin) acquireLeadership() bool {
+	leader, err := p.claimKey(leaderKey, leaderLockSeconds)
+	if err != nil {
+		p.API.LogError("can't get leader lock", "err", err.Error())
+		return false
+	}
+	if !leader {
+		return false
+	}
+	if err := p.API.KVSetWithExpiry(leaderKey, []byte(p.nodeID), leaderLockSeconds); err != nil {
+		p.API.LogError("can't renew leader lock", "err", err.Error())
+		return false
+	}
+	return true
+}
+
+// claimRun return true if this node sends the report of a run, so a report is sent once
+// even if two nodes both think they are the leader, see claimKey for when it can be sent twice
+func (p *Plugin) claimRun(name string, run time.Time) bool {
+	key := fmt.Sprintf("%s%s-%d", sentRunPrefix, name, run.Unix())
+	claimed, err := p.claimKey(key, sentRunSeconds)
+	if err != nil {
+		p.API.LogError("can't claim report run", "key", key, "err", err.Error())
+		return false
+	}
+	return claimed
+}
+
+// releaseLeadership free the leader lock so another node can take it without waiting its expiry
+func (p *Plugin) releaseLeadership() {
+	j, err := p.API.KVGet(leaderKey)
+	if err != nil || string(j) != p.nodeID {
+		return
+	}
+	if err := p.API.KVDelete(leaderKey); err != nil {
+		p.API.LogWarn("can't release leader lock", "err", err.Error())
+	}
+}
+
+// listKeys return all keys of this plugin matching keep
+func (p *Plugin) listKeys(keep func(string) bool) ([]string, error) {
+	keys := make([]string, 0)
+	for page := 0; ; page++ {
+		list, err := p.API.KVList(page, kvListPerPage)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't list keys")
+		}
+		for _, key := range list {
+			if keep(key) {
+				keys = append(keys, key)
+			}
+		}
+		if len(list) < kvListPerPage {
+			return keys, nil
+		}
+	}
+}
+
+// loadKey load an analytic stored under a key, nil if the key is empty
+func (p *Plugin) loadKey(key string) (*Analytic, error) {
+	j, err := p.API.KVGet(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get "+key)
+	}
+	if len(j) == 0 {
+		return nil, nil
+	}
+	return p.decodeOrQuarantine(key, j)
+}
+
+// openBuckets return buckets not merged in closed buckets yet: partials and current buckets of other nodes
+// current bucket of this node is not included, callers read it from memory
+func (p *Plugin) openBuckets() []*Analytic {
+	buckets := make([]*Analytic, 0)
+	keys, err := p.openKeys()
+	if err != nil {
+		p.API.LogError("can't list open buckets", "err", err.Error())
+		return buckets
+	}
+	for _, key := range keys {
+		bucket, err := p.loadKey(key)
+		if err != nil {
+			p.API.LogWarn("can't load open bucket", "key", key, "err", err.Error())
+			continue
+		}
+		if bucket != nil {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// mergePartials merge partials of all nodes in closed buckets, only the leader calls it
+func (p *Plugin) mergePartials() {
+	p.historyLock.Lock()
+	defer p.historyLock.Unlock()
+
+	if err := p.foldPartials(func(time.Time) bool { return true }); err != nil {
+		p.API.LogError("can't merge partials, they are kept", "err", err.Error())
+	}
+}
+
+// foldPartials merge partials starting in keep in closed buckets and delete them, caller must hold historyLock
+// current buckets of nodes without heartbeat which didn't close them for an hour are merged too,
+// a running node keeps its bucket until it saves it as a partial
+// partials of backfilled periods are deleted without being merged, see finishBackfill
+func (p *Plugin) foldPartials(keep func(start time.Time) bool) error {
+	keys, err := p.openKeys()
+	if err != nil {
+		return errors.Wrap(err, "can't list partials")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	index, err := p.bucketsIndex()
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]bool, len(index))
+	for _, ref := range index {
+		indexed[ref.key()] = true
+	}
+	backfilled, err := p.loadBackfilled()
+	if err != nil {
+		return err
+	}
+
+	stale := bucketStart(time.Now()).Add(-bucketDuration)
+	buckets := make(map[string]*Analytic)
+	merged := make([]string, 0, len(keys))
+	for _, key := range keys {
+		partial, err := p.loadKey(key)
+		if err != nil {
+			p.API.LogWarn("can't load partial", "key", key, "err", err.Error())
+			continue
+		}
+		if partial == nil || !keep(partial.Start) {
+			continue
+		}
+		if isNodeCurrentKey(key) {
+			if !partial.Start.Before(stale) {
+				continue
+			}
+			if key == currentAnalyticKey {
+				// the session of previous versions keeps its start, it was counted until nodes had their own key
+				if partial.End.IsZero() {
+					partial.End = bucketStart(time.Now())
+				}
+			} else {
+				running, err := p.isRunning(strings.TrimPrefix(key, nodeCurrentPrefix))
+				if err != nil {
+					p.API.LogWarn("can't get heartbeat, current bucket is kept", "key", key, "err", err.Error())
+					continue
+				}
+				if running {
+					continue
+				}
+				partial.End = partial.Start.Add(bucketDuration)
+			}
+		}
+		if isBackfilled(backfilled, partial.Start) {
+			// its posts were counted by the backfill, it was closed after the backfill finished
+			p.API.LogInfo("drop partial of a backfilled period", "key", key)
+			merged = append(merged, key)
+			continue
+		}
+
+		ref := bucketRef{Start: partial.Start, End: partial.End}
+		bucket, ok := buckets[ref.key()]
+		if !ok {
+			bucket = NewAnalytic()
+			bucket.Start = ref.Start
+			bucket.End = ref.End
+			if indexed[ref.key()] {
+				existing, err := p.loadBucket(ref)
+				if err != nil {
+					p.API.LogWarn("can't load bucket, partial is kept", "key", ref.key(), "err", err.Error())
+					continue
+				}
+				bucket.Merge(existing)
+			}
+			buckets[ref.key()] = bucket
+		}
+		bucket.Merge(partial)
+		merged = append(merged, key)
+	}
+
+	for key, bucket := range buckets {
+		ref, err := p.saveBucket(bucket)
+		if err != nil {
+			return err
+		}
+		if !indexed[key] {
+			index = append(index, ref)
+			continue
+		}
+		for i := range index {
+			if index[i].key() == key {
+				index[i] = ref
+			}
+		}
+	}
+	if err := p.saveBucketsIndex(index); err != nil {
+		return err
+	}
+	for _, key := range merged {
+		if err := p.API.KVDelete(key); err != nil {
+			p.API.LogWarn("can't delete partial", "key", key, "err", err.Error())
+		}
+	}
+	for _, key := range merged {
+		if strings.HasPrefix(key, nodeCurrentPrefix) {
+			p.forgetNode(strings.TrimPrefix(key, nodeCurrentPrefix))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Plugin{nodeID: getNodeID()}
+	assert.Len(p.nodeID, 8)
+	assert.True(isNodeCurrentKey(p.nodeCurrentKey()))
+	assert.True(isNodeCurrentKey(currentAnalyticKey))
+	assert.False(isNodeCurrentKey(bucketRef{Start: time.Unix(0, 0), End: time.Unix(3600, 0)}.key()))
+	assert.False(isNodeCurrentKey(bucketsIndexKey))
+
+	bucket := NewAnalytic()
+	key := p.partialKey(bucket)
+	assert.True(isPartialKey(key))
+	assert.False(isNodeCurrentKey(key))
+	assert.True(len(key) <= 50)
+}
+
+func TestFoldPartials(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &kvAPI{kv: map[string][]byte{
+		nodesKey:                  []byte(`["node1","node2","node3"]`),
+		heartbeatPrefix + "node2": []byte("node2"),
+	}}
+	p := &Plugin{nodeID: "node1"}
+	p.API = api
+	start := bucketStart(time.Now()).Add(-2 * bucketDuration)
+	legacyStart := start.AddDate(0, 0, -7)
+	for key, since := range map[string]time.Time{
+		nodeCurrentPrefix + "node2": start,
+		nodeCurrentPrefix + "node3": start,
+		currentAnalyticKey:          legacyStart,
+	} {
+		bucket := NewAnalytic()
+		bucket.Start = since
+		bucket.Channels["chan1"] = 1
+		j, err := encodeAnalytic(bucket)
+		assert.Nil(err)
+		api.kv[key] = j
+	}
+
+	assert.Nil(p.foldPartials(func(time.Time) bool { return true }))
+	index, err := p.bucketsIndex()
+	assert.Nil(err)
+	assert.Len(index, 2)
+	// the session of previous versions keeps its start, the bucket of a stopped node is closed with its hour
+	assert.True(legacyStart.Equal(index[0].Start))
+	assert.True(bucketStart(time.Now()).Equal(index[0].End))
+	assert.True(start.Equal(index[1].Start))
+	assert.True(start.Add(bucketDuration).Equal(index[1].End))
+	// a running node keeps its current bucket
+	assert.NotNil(api.kv[nodeCurrentPrefix+"node2"])
+	assert.Nil(api.kv[nodeCurrentPrefix+"node3"])
+	assert.Nil(api.kv[currentAnalyticKey])
+
+	// a partial closed after a backfill of its hour is dropped
+	backfilled, err := json.Marshal([]bucketRef{{Start: start, End: start.Add(bucketDuration)}})
+	assert.Nil(err)
+	api.kv[backfilledKey] = backfilled
+	late := NewAnalytic()
+	late.Start = start
+	late.Channels["chan1"] = 1
+	p.nodeID = "node2"
+	assert.Nil(p.savePartial(late))
+	assert.Nil(p.foldPartials(func(time.Time) bool { return true }))
+	assert.Nil(api.kv[p.partialKey(late)])
+	bucket, err := p.loadBucket(index[1])
+	assert.Nil(err)
+	assert.Equal(int64(1), bucket.Channels["chan1"])
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	dateLayout = "2006-01-02"
+)
+
+// commandParams are the arguments and flags given to a subcommand
+type commandParams struct {
+	subcommand string
+	args       []string
+	period     period
+}
+
+// subcommand describe one action of /analytics
+// execute return the attachments to post in the channel where the command was run, built for its members
+// reply, used instead of execute when set, return a text only displayed to the user
+// ephemeral attachments are only displayed to the user instead of being posted
+type subcommand struct {
+	name        string
+	hint        string
+	description string
+	help        string
+	adminOnly   bool
+	ephemeral   bool
+	execute     func(p *Plugin, args *model.CommandArgs, params *commandParams) ([]*model.SlackAttachment, error)
+	reply       func(p *Plugin, args *model.CommandArgs, params *commandParams) (string, error)
+}
+
+var subcommands = []subcommand{
+	{
+		name:        "channel",
+		hint:        "channel",
+		description: "Display analytics of this channel (default)",
+		help:        "Display top posters, replies, files uploaded and the weekly trend of the channel where the command is run, last 7 days by default.",
+		execute: func(p *Plugin, args *model.CommandArgs, params *commandParams) ([]*model.SlackAttachment, error) {
+			return p.buildChannelAnalyticAttachments(params.period, args.ChannelId, newChannelViewer(args.ChannelId))
+		},
+	},
+	{
+		name:        "team",
+		hint:        "team",
+		description: "Display analytics of this team",
+		help:        "Display top users and top channels of the team where the command is run.",
+		execute: func(p *Plugin, args *model.CommandArgs, params *commandParams) ([]*model.SlackAttachment, error) {
+			if args.TeamId == "" {
+				return nil, newCommandError("The team subcommand must be run in a channel of a team")
+			}
+			return p.buildTeamAnalyticAttachments(params.period, args.TeamId, newChannelViewer(args.ChannelId))
+		},
+	},
+	{
+		name:        "user",
+		hint:        "user @username",
+		description: "Display analytics of a user",
+		help:        "Display messages, replies and most active channels of the given user.",
+		execute: func(p *Plugin, args *model.CommandArgs, params *commandParams) ([]*model.SlackAttachment, error) {
+			if len(params.args) != 1 {
+				return nil, newCommandError("Need exactly one username")
+			}
+			username := strings.TrimPrefix(params.args[0], "@")
+			user, appErr := p.API.GetUserByUsername(username)
+			if appErr != nil {
+				return nil, newCommandError(fmt.Sprintf("Unknown user: @%s", username))
+			}
+			return p.buildUserAnalyticAttachments(params.period, user.Id, newChannelViewer(args.ChannelId))
+		},
+	},
+	{
+		name:        "me",
+		hint:        "me",
+		description: "Display your own analytics, only to you",
+		help:        "Display your messages and replies, the channels where you were the most active, the files you shared and your trend compared to the previous period. Nobody else sees it.",
+		ephemeral:   true,
+		execute: func(p *Plugin, args *model.CommandArgs, params *commandParams) ([]*model.SlackAttachment, error) {
+			return p.buildPersonalAttachments(params.period, args.UserId)
+		},
+	},
+	{
+		name:        "digest",
+		hint:        "digest on|off",
+		description: "Receive your own analytics every week by direct message",
+		help:        "Opt in with `on` to receive the analytics of `/analytics me` for the last 7 days by direct message every Monday, opt out with `off`.",
+		reply: func(p *Plugin, args *model.CommandArgs, params *commandParams) (string, error) {
+			if len(params.args) != 1 {
+				return "", newCommandError("Need on or off")
+			}
+			switch params.args[0] {
+			case "on":
+				if err := p.setDigestSubscription(args.UserId, true); err != nil {
+					return "", err
+				}
+				return "You will receive your analytics every week by direct message.", nil
+			case "off":
+				if err := p.setDigestSubscription(args.UserId, false); err != nil {
+					return "", err
+				}
+				return "You won't receive your weekly analytics anymore.", nil
+			default:
+				return "", newCommandError(fmt.Sprintf("Unknown argument: %s", params.args[0]))
+			}
+		},
+	},
+	{
+		name:        "optout",
+		hint:        "optout [off]",
+		description: "Remove yourself from user rankings",
+		help:        "Remove your name from top users, fastest responders, most appreciated and charts of all reports. Your messages are still counted in totals. Use `off` to be ranked again.",
+		reply: func(p *Plugin, args *model.CommandArgs, params *commandParams) (string, error) {
+			if len(params.args) > 1 {
+				return "", newCommandError("Too many arguments")
+			}
+			if len(params.args) == 1 {
+				if params.args[0] != "off" {
+					return "", newCommandError(fmt.Sprintf("Unknown argument: %s", params.args[0]))
+				}
+				if err := p.setOptOut(args.UserId, false); err != nil {
+					return "", err
+				}
+				return "You are ranked again in reports.", nil
+			}
+			if err := p.setOptOut(args.UserId, true); err != nil {
+				return "", err
+			}
+			return "You won't appear in user rankings anymore, your messages are still counted in totals.", nil
+		},
+	},
+	{
+		name:        "files",
+		hint:        "files",
+		description: "Display analytics of uploaded files",
+		help:        "Display number and weight of uploaded files and the channels where most of them were sent.",
+		execute: func(p *Plugin, args *model.CommandArgs, params *commandParams) ([]*model.SlackAttachment, error) {
+			return p.buildFilesAnalyticAttachments(params.period, newChannelViewer(args.ChannelId))
+		},
+	},
+	{
+		name:        "trends",
+		hint:        "trends",
+		description: "Display trends of all channels",
+		help:        "Display a line chart of messages by channel for each week (or each day for periods shorter than two weeks), last 12 weeks by default.",
+		execute: func(p *Plugin, args *model.CommandArgs, params *commandParams) ([]*model.SlackAttachment, error) {
+			return p.buildTrendsAnalyticAttachments(params.period, newChannelViewer(args.ChannelId))
+		},
+	},
+	{
+		name:        "global",
+		hint:        "global",
+		description: "Display analytics of the whole instance",
+		help:        "Display top users, top channels and trends of the whole instance, like the weekly report.",
+		execute: func(p *Plugin, args *model.CommandArgs, params *commandParams) ([]*model.SlackAttachment, error) {
+			return p.buildAnalyticAttachments(params.period, newChannelViewer(args.ChannelId))
+		},
+	},
+	{
+		name:        "backfill",
+		hint:        "backfill [status|cancel]",
+		description: "Count existing posts since a date (admin only)",
+		help:        "Count all posts sent since `--since` and replace analytics of this period, useful after installing the plugin. It runs in background and resumes after a restart, use `status` to follow it and `cancel` to stop it.",
+		adminOnly:   true,
+		reply: func(p *Plugin, args *model.CommandArgs, params *commandParams) (string, error) {
+			if len(params.args) > 1 {
+				return "", newCommandError("Too many arguments")
+			}
+			if len(params.args) == 1 {
+				switch params.args[0] {
+				case "status":
+					return p.backfillStatus(), nil
+				case "cancel":
+					if err := p.cancelBackfill(); err != nil {
+						return "", err
+					}
+					return "Backfill canceled.", nil
+				default:
+					return "", newCommandError(fmt.Sprintf("Unknown argument: %s", params.args[0]))
+				}
+			}
+			if params.period.since.IsZero() {
+				return "", newCommandError("Need --since to start a backfill")
+			}
+			if !params.period.until.IsZero() {
+				return "", newCommandError("A backfill always ends now, --until is not supported")
+			}
+			if err := p.startBackfill(args.UserId, args.ChannelId, params.period.since); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Backfill since %s started, you will be notified when it's done.", params.period.since.Format("January 2, 2006")), nil
+		},
+	},
+}
+
+// commandError is an error caused by the user input, its message is displayed as is
+type commandError struct {
+	message string
+}
+
+func newCommandError(message string) *commandError {
+	return &commandError{message: message}
+}
+
+func (e *commandError) Error() string {
+	return e.message
+}
+
+// executeSubcommand parse and run a /analytics command, errors are returned as ephemeral responses
+func (p *Plugin) executeSubcommand(args *model.CommandArgs) *model.CommandResponse {
+	params, err := parseCommand(args.Command, p.getConfiguration().getReportLocation())
+	if err != nil {
+		return ephemeralResponse(fmt.Sprintf("%s\n\n%s", err.Error(), getUsage()))
+	}
+
+	if params.subcommand == "help" {
+		return ephemeralResponse(getHelp(params.args))
+	}
+
+	sub := findSubcommand(params.subcommand)
+	if sub == nil {
+		return ephemeralResponse(fmt.Sprintf("Unknown subcommand: %s\n\n%s", params.subcommand, getUsage()))
+	}
+
+	if sub.adminOnly && !p.API.HasPermissionTo(args.UserId, model.PERMISSION_MANAGE_SYSTEM) {
+		return ephemeralResponse(fmt.Sprintf("Only system admins can use `/%s %s`", CommandTrigger, sub.name))
+	}
+
+	if sub.reply != nil {
+		text, err := sub.reply(p, args, params)
+		if err != nil {
+			if cmdErr, ok := errors.Cause(err).(*commandError); ok {
+				return ephemeralResponse(fmt.Sprintf("%s\n\n%s", cmdErr.Error(), getSubcommandHelp(sub)))
+			}
+			p.API.LogError("can't run subcommand", "subcommand", sub.name, "err", err.Error())
+			return ephemeralResponse("An error occured!")
+		}
+		return ephemeralResponse(text)
+	}
+
+	attachments, err := sub.execute(p, args, params)
+	if err != nil {
+		if cmdErr, ok := errors.Cause(err).(*commandError); ok {
+			return ephemeralResponse(fmt.Sprintf("%s\n\n%s", cmdErr.Error(), getSubcommandHelp(sub)))
+		}
+		p.API.LogError("can't build analytics", "subcommand", sub.name, "err", err.Error())
+		return ephemeralResponse("An error occured!")
+	}
+	if sub.ephemeral {
+		response := ephemeralResponse("")
+		response.Attachments = attachments
+		return response
+	}
+	if err := p.postAttachments(args.ChannelId, attachments); err != nil {
+		p.API.LogError("can't send analytics", "err", err.Error())
+		return ephemeralResponse("An error occured!")
+	}
+
+	return &model.CommandResponse{}
+}
+
+// parseCommand split a command in subcommand, arguments and flags
+// flags can be written `--since 2019-01-01` or `--since=2019-01-01`, dates are read in location
+func parseCommand(command string, location *time.Location) (*commandParams, error) {
+	params := &commandParams{args: make([]string, 0)}
+	fields := strings.Fields(command)
+	if len(fields) > 0 {
+		fields = fields[1:] // skip /analytics
+	}
+
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		if !strings.HasPrefix(field, "--") {
+			if params.subcommand == "" {
+				params.subcommand = field
+			} else {
+				params.args = append(params.args, field)
+			}
+			continue
+		}
+
+		name := strings.TrimPrefix(field, "--")
+		value := ""
+		if index := strings.Index(name, "="); index >= 0 {
+			value = name[index+1:]
+			name = name[:index]
+		} else if i+1 < len(fields) {
+			i++
+			value = fields[i]
+		}
+		if value == "" {
+			return nil, newCommandError(fmt.Sprintf("Missing value for flag --%s", name))
+		}
+
+		if err := setPeriodFlag(&params.period, name, value, location); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkPeriod(params.period); err != nil {
+		return nil, err
+	}
+	if params.subcommand == "" {
+		params.subcommand = "channel"
+	}
+	return params, nil
+}
+
+// setPeriodFlag parse the value of a --since or --until flag in a period
+// it's shared by the command and the api, where flags are query parameters
+// the date is read in location, the time zone of the reports, so days match buckets
+func setPeriodFlag(pe *period, name string, value string, location *time.Location) error {
+	date, err := time.ParseInLocation(dateLayout, value, location)
+	if err != nil {
+		return newCommandError(fmt.Sprintf("Bad date for flag --%s: %s, expected format is YYYY-MM-DD", name, value))
+	}
+	switch name {
+	case "since":
+		pe.since = date
+	case "until":
+		// until is inclusive, so the period ends at the end of this day
+		pe.until = date.AddDate(0, 0, 1)
+	default:
+		return newCommandError(fmt.Sprintf("Unknown flag: --%s", name))
+	}
+	return nil
+}
+
+func checkPeriod(pe period) error {
+	if !pe.since.IsZero() && !pe.until.IsZero() && !pe.since.Before(pe.until) {
+		return newCommandError("--since must be before --until")
+	}
+	return nil
+}
+
+func findSubcommand(name string) *subcommand {
+	for index := range subcommands {
+		if subcommands[index].name == name {
+			return &subcommands[index]
+		}
+	}
+	return nil
+}
+
+// getAutocompleteHint list all subcommands and flags, displayed by mattermost while typing
+func getAutocompleteHint() string {
+	hints := make([]string, 0, len(subcommands)+1)
+	for _, sub := range subcommands {
+		hints = append(hints, sub.name)
+	}
+	hints = append(hints, "help")
+	return fmt.Sprintf("[%s] [--since YYYY-MM-DD] [--until YYYY-MM-DD]", strings.Join(hints, "|"))
+}
+
+func getUsage() string {
+	usage := "#### Usage\n"
+	for _, sub := range subcommands {
+		usage += fmt.Sprintf("* `/%s %s`: %s\n", CommandTrigger, sub.hint, sub.description)
+	}
+	usage += fmt.Sprintf("* `/%s help [subcommand]`: Display this help or the help of a subcommand\n", CommandTrigger)
+	usage += "\nAll subcommands accept `--since YYYY-MM-DD` and `--until YYYY-MM-DD` to choose the period to analyze, last 7 days by default."
+	return usage
+}
+
+func getHelp(args []string) string {
+	if len(args) == 0 {
+		return getUsage()
+	}
+	sub := findSubcommand(args[0])
+	if sub == nil {
+		return fmt.Sprintf("Unknown subcommand: %s\n\n%s", args[0], getUsage())
+	}
+	return getSubcommandHelp(sub)
+}
+
+func getSubcommandHelp(sub *subcommand) string {
+	return fmt.Sprintf("#### `/%s %s [--since YYYY-MM-DD] [--until YYYY-MM-DD]`\n%s", CommandTrigger, sub.hint, sub.help)
+}
+
+func ephemeralResponse(text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
+		Text:         text,
+	}
+}
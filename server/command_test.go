@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	params, err := parseCommand("/analytics", time.Local)
+	assert.Nil(err)
+	assert.Equal("channel", params.subcommand)
+	assert.Empty(params.args)
+	assert.True(params.period.since.IsZero())
+	assert.True(params.period.until.IsZero())
+
+	params, err = parseCommand("/analytics user @john --since 2019-03-01 --until=2019-03-31", time.Local)
+	assert.Nil(err)
+	assert.Equal("user", params.subcommand)
+	assert.Equal([]string{"@john"}, params.args)
+	assert.Equal(time.Date(2019, 3, 1, 0, 0, 0, 0, time.Local), params.period.since)
+	assert.Equal(time.Date(2019, 4, 1, 0, 0, 0, 0, time.Local), params.period.until)
+
+	paris, err := time.LoadLocation("Europe/Paris")
+	assert.Nil(err)
+	params, err = parseCommand("/analytics --since 2019-03-01 --until=2019-03-31", paris)
+	assert.Nil(err)
+	assert.Equal(time.Date(2019, 3, 1, 0, 0, 0, 0, paris), params.period.since)
+	assert.Equal(time.Date(2019, 4, 1, 0, 0, 0, 0, paris), params.period.until)
+
+	_, err = parseCommand("/analytics --since", time.Local)
+	assert.EqualError(err, "Missing value for flag --since")
+
+	_, err = parseCommand("/analytics --since 01/03/2019", time.Local)
+	assert.EqualError(err, "Bad date for flag --since: 01/03/2019, expected format is YYYY-MM-DD")
+
+	_, err = parseCommand("/analytics --from 2019-03-01", time.Local)
+	assert.EqualError(err, "Unknown flag: --from")
+
+	_, err = parseCommand("/analytics --since 2019-03-02 --until 2019-03-01", time.Local)
+	assert.EqualError(err, "--since must be before --until")
+}
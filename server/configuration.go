@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -20,10 +22,37 @@ import (
 // If you add non-reference types to your configuration struct, be sure to rewrite Clone as a deep
 // copy appropriate for your types.
 type configuration struct {
-	Username      string
-	TeamsChannels string
-	BotUsername   string
-	BotIconURL    string
+	Username             string
+	TeamsChannels        string
+	BotUsername          string
+	BotIconURL           string
+	RetentionDays        string
+	CompactAfterDays     string
+	ReportSchedule       string
+	ReportTimeZone       string
+	ChannelsSchedules    string
+	SendLateReports      bool
+	MetricsToken         string
+	MetricsByUser        bool
+	ChartsExpiryDays     string
+	ChartsFormat         string
+	ChartsScale          string
+	ChartsPixelRatio     string
+	TrackReactions       bool
+	TrackDeletions       bool
+	SubtractDeletedPosts bool
+	HeatmapTimeZone      string
+	BotAccounts          string
+	CountIntegrations    bool
+	TeamReportsChannels  string
+	AnonymizeUsers       string
+
+	// heatmapLocation is the time zone of heatmaps, loaded once by OnConfigurationChange
+	heatmapLocation *time.Location
+	// reportLocation is the time zone of report days, loaded once by OnConfigurationChange
+	reportLocation *time.Location
+	// botUserIDs are ids of users of BotAccounts, loaded once by OnConfigurationChange
+	botUserIDs map[string]bool
 }
 
 // IsValid validates if all the required fields are set.
@@ -43,10 +72,157 @@ func (c *configuration) IsValid() error {
 	if c.BotIconURL == "" {
 		return errors.New("Need BotIconURL")
 	}
+	if _, err := parseDays(c.RetentionDays); err != nil {
+		return errors.Wrap(err, "RetentionDays must be a number of days")
+	}
+	if _, err := parseDays(c.CompactAfterDays); err != nil {
+		return errors.Wrap(err, "CompactAfterDays must be a number of days")
+	}
+	if _, err := parseDays(c.ChartsExpiryDays); err != nil {
+		return errors.Wrap(err, "ChartsExpiryDays must be a number of days")
+	}
+	if c.ChartsFormat != "" && c.ChartsFormat != "svg" && c.ChartsFormat != "png" {
+		return errors.New("ChartsFormat must be svg or png")
+	}
+	if _, err := parseRatio(c.ChartsScale); err != nil {
+		return errors.Wrap(err, "ChartsScale must be a positive number")
+	}
+	if _, err := parseRatio(c.ChartsPixelRatio); err != nil {
+		return errors.Wrap(err, "ChartsPixelRatio must be a positive number")
+	}
+	if _, err := parseSchedule(c.getReportSchedule(), c.ReportTimeZone); err != nil {
+		return errors.Wrap(err, "ReportSchedule must be a cron expression and ReportTimeZone a time zone like Europe/Paris")
+	}
+	if _, err := time.LoadLocation(c.getHeatmapTimeZone()); err != nil {
+		return errors.Wrap(err, "HeatmapTimeZone must be a time zone like Europe/Paris")
+	}
+	if c.TeamReportsChannels != "" && strings.Count(c.TeamReportsChannels, ",")+1 != strings.Count(c.TeamReportsChannels, "/") {
+		return errors.New("TeamReportsChannels must be in form TeamName/ChannelName")
+	}
+	if c.AnonymizeUsers != "" && c.AnonymizeUsers != anonymizePseudonyms && c.AnonymizeUsers != anonymizeHidden {
+		return errors.New("AnonymizeUsers must be pseudonyms or hidden")
+	}
+	channelsSchedules, err := parseChannelsSchedules(c.ChannelsSchedules)
+	if err != nil {
+		return errors.Wrap(err, "ChannelsSchedules must be in form TeamName/ChannelName=schedule;TeamName/ChannelName=schedule")
+	}
+	for _, channelSchedule := range channelsSchedules {
+		if _, err := parseSchedule(channelSchedule.spec, c.getChannelTimeZone(channelSchedule)); err != nil {
+			return errors.Wrap(err, "bad schedule for "+channelSchedule.teamChannel)
+		}
+	}
 
 	return nil
 }
 
+// getRetentionDays return the number of days buckets are kept, 0 to keep them forever
+func (c *configuration) getRetentionDays() int {
+	days, _ := parseDays(c.RetentionDays)
+	return days
+}
+
+// getCompactAfterDays return the number of days after which hourly buckets are merged by day, 0 to never merge them
+func (c *configuration) getCompactAfterDays() int {
+	days, _ := parseDays(c.CompactAfterDays)
+	return days
+}
+
+// getChartsExpiryDays return the number of days charts of a report can be displayed, 0 to keep them forever
+func (c *configuration) getChartsExpiryDays() int {
+	days, _ := parseDays(c.ChartsExpiryDays)
+	return days
+}
+
+// getChartsFormat return the extension of charts in reports, svg by default
+func (c *configuration) getChartsFormat() string {
+	if c.ChartsFormat == "" {
+		return "svg"
+	}
+	return c.ChartsFormat
+}
+
+// getChartsScale return the factor applied to the size of charts, 1 by default
+func (c *configuration) getChartsScale() float64 {
+	scale, _ := parseRatio(c.ChartsScale)
+	return scale
+}
+
+// getChartsPixelRatio return the device pixel ratio of png charts, 1 by default
+func (c *configuration) getChartsPixelRatio() float64 {
+	ratio, _ := parseRatio(c.ChartsPixelRatio)
+	return ratio
+}
+
+// getReportSchedule return the cron expression of the report, weekly by default
+func (c *configuration) getReportSchedule() string {
+	if strings.TrimSpace(c.ReportSchedule) == "" {
+		return defaultReportSchedule
+	}
+	return strings.TrimSpace(c.ReportSchedule)
+}
+
+// getHeatmapTimeZone return the time zone of heatmaps, the one of reports by default
+func (c *configuration) getHeatmapTimeZone() string {
+	if c.HeatmapTimeZone == "" {
+		return c.ReportTimeZone
+	}
+	return c.HeatmapTimeZone
+}
+
+// getHeatmapLocation return the location of heatmaps, the local one when it can't be loaded
+func (c *configuration) getHeatmapLocation() *time.Location {
+	if c.heatmapLocation == nil {
+		return time.Local
+	}
+	return c.heatmapLocation
+}
+
+// getReportLocation return the location of report days, the local one when it can't be loaded
+func (c *configuration) getReportLocation() *time.Location {
+	if c.reportLocation == nil {
+		return time.Local
+	}
+	return c.reportLocation
+}
+
+// getChannelTimeZone return the time zone of a destination schedule, ReportTimeZone if it has none
+func (c *configuration) getChannelTimeZone(channelSchedule channelSchedule) string {
+	if channelSchedule.timeZone == "" {
+		return c.ReportTimeZone
+	}
+	return channelSchedule.timeZone
+}
+
+// parseDays parse a positive number of days, empty means 0
+func parseDays(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if days < 0 {
+		return 0, fmt.Errorf("%d is negative", days)
+	}
+	return days, nil
+}
+
+// parseRatio parse a strictly positive number, empty means 1
+func parseRatio(value string) (float64, error) {
+	if value == "" {
+		return 1, nil
+	}
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 1, err
+	}
+	if ratio <= 0 {
+		return 1, fmt.Errorf("%s is not positive", value)
+	}
+	return ratio, nil
+}
+
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
 // your configuration has reference types.
 func (c *configuration) Clone() *configuration {
@@ -103,6 +279,13 @@ func (p *Plugin) OnConfigurationChange() error {
 	if err := p.API.LoadPluginConfiguration(configuration); err != nil {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
+	if location, err := time.LoadLocation(configuration.getHeatmapTimeZone()); err == nil {
+		configuration.heatmapLocation = location
+	}
+	if location, err := time.LoadLocation(configuration.ReportTimeZone); err == nil {
+		configuration.reportLocation = location
+	}
+	configuration.botUserIDs = p.getBotUserIDs(configuration.BotAccounts)
 
 	p.setConfiguration(configuration)
 
@@ -116,33 +299,168 @@ func (p *Plugin) OnConfigurationChange() error {
 	}
 	p.BotUserID = user.Id
 
-	channelsID, err := p.parseChannelsFromConfig(configuration)
+	schedules, err := p.parseSchedulesFromConfig(configuration)
 	if err != nil {
 		return err
 	}
-	p.ChannelsID = channelsID
+	p.setSchedules(schedules)
+
+	return p.restartCron()
+}
+
+// getSchedules return schedules of reports under lock, the slice returned is never modified
+func (p *Plugin) getSchedules() []*reportSchedule {
+	p.configurationLock.RLock()
+	defer p.configurationLock.RUnlock()
+
+	return p.schedules
+}
+
+// setSchedules replaces schedules of reports under lock, the cron must be restarted to run them
+func (p *Plugin) setSchedules(schedules []*reportSchedule) {
+	p.configurationLock.Lock()
+	defer p.configurationLock.Unlock()
+
+	p.schedules = schedules
+}
+
+// restartCron replaces the running cron by one with the current schedules
+// OnConfigurationChange is called before OnActivate, cron is started there the first time
+func (p *Plugin) restartCron() error {
+	p.cronLock.Lock()
+	defer p.cronLock.Unlock()
 
+	if p.cron == nil {
+		return nil
+	}
+	p.cron.Stop()
+	c, err := NewCron(p, p.getSchedules())
+	if err != nil {
+		return errors.Wrap(err, "can't restart cron")
+	}
+	p.cron = c
 	return nil
 }
 
-func (p *Plugin) parseChannelsFromConfig(configuration *configuration) ([]string, error) {
+// getBotUserIDs return ids of users of a comma separated list of usernames, unknown users are ignored
+func (p *Plugin) getBotUserIDs(usernames string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, username := range strings.Split(usernames, ",") {
+		username = strings.TrimPrefix(strings.TrimSpace(username), "@")
+		if username == "" {
+			continue
+		}
+		user, appErr := p.API.GetUserByUsername(username)
+		if appErr != nil {
+			p.API.LogWarn("can't find bot account", "username", username, "err", appErr.Error())
+			continue
+		}
+		ids[user.Id] = true
+	}
+	return ids
+}
+
+// parseSchedulesFromConfig return schedules of all destinations
+// destinations with their own schedule in ChannelsSchedules don't receive the default report
+func (p *Plugin) parseSchedulesFromConfig(configuration *configuration) ([]*reportSchedule, error) {
+	defaultSchedule, err := parseSchedule(configuration.getReportSchedule(), configuration.ReportTimeZone)
+	if err != nil {
+		return nil, err
+	}
+	channelsSchedules, err := parseChannelsSchedules(configuration.ChannelsSchedules)
+	if err != nil {
+		return nil, err
+	}
+
+	teamChannelsID, teams, err := p.parseTeamReportsFromConfig(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := make([]*reportSchedule, 0, len(channelsSchedules)+1)
+	overridden := make(map[string]bool)
+	for _, channelSchedule := range channelsSchedules {
+		channelID, err := p.getChannelIDFromConfig(channelSchedule.teamChannel)
+		if err != nil {
+			return nil, err
+		}
+		schedule, err := parseSchedule(channelSchedule.spec, configuration.getChannelTimeZone(channelSchedule))
+		if err != nil {
+			return nil, err
+		}
+		overridden[channelID] = true
+		schedules = append(schedules, newReportSchedule(channelSchedule.spec, configuration.getChannelTimeZone(channelSchedule), schedule, []string{channelID}))
+	}
+
+	channelsID, err := p.parseChannelsFromConfig(configuration)
+	if err != nil {
+		return nil, err
+	}
+	// destinations of team reports follow the default schedule too, a channel listed twice gets one report
+	defaultChannelsID := make([]string, 0, len(channelsID)+len(teamChannelsID))
+	listed := make(map[string]bool)
+	for _, channelID := range append(channelsID, teamChannelsID...) {
+		if !overridden[channelID] && !listed[channelID] {
+			listed[channelID] = true
+			defaultChannelsID = append(defaultChannelsID, channelID)
+		}
+	}
+	schedules = append(schedules, newReportSchedule(configuration.getReportSchedule(), configuration.ReportTimeZone, defaultSchedule, defaultChannelsID))
+	for _, schedule := range schedules {
+		schedule.teams = teams
+	}
+	return schedules, nil
+}
+
+// parseTeamReportsFromConfig return channels of TeamReportsChannels and their team ids by channel id
+func (p *Plugin) parseTeamReportsFromConfig(configuration *configuration) ([]string, map[string]string, error) {
 	channelsID := make([]string, 0)
-	for _, teamsChannels := range strings.Split(configuration.TeamsChannels, ",") {
-		v := strings.Split(teamsChannels, "/")
-		if len(v) != 2 {
-			return channelsID, fmt.Errorf("Bad formatted TeamsChannels: %v", teamsChannels)
+	teams := make(map[string]string)
+	if strings.TrimSpace(configuration.TeamReportsChannels) == "" {
+		return channelsID, teams, nil
+	}
+	for _, teamChannel := range strings.Split(configuration.TeamReportsChannels, ",") {
+		channelID, err := p.getChannelIDFromConfig(strings.TrimSpace(teamChannel))
+		if err != nil {
+			return nil, nil, err
 		}
-		teamName := v[0]
-		channelName := v[1]
-		team, errC := p.API.GetTeamByName(teamName)
-		if errC != nil {
-			return channelsID, fmt.Errorf("Unable to find team with configured team: %v", teamName)
+		teamID, err := p.getChannelTeamID(channelID)
+		if err != nil {
+			return nil, nil, err
 		}
-		channel, errC := p.API.GetChannelByName(team.Id, channelName, false)
-		if errC != nil {
-			return channelsID, fmt.Errorf("Unable to find channel with configured channel: %v", channelName)
+		channelsID = append(channelsID, channelID)
+		teams[channelID] = teamID
+	}
+	return channelsID, teams, nil
+}
+
+func (p *Plugin) parseChannelsFromConfig(configuration *configuration) ([]string, error) {
+	channelsID := make([]string, 0)
+	for _, teamsChannels := range strings.Split(configuration.TeamsChannels, ",") {
+		channelID, err := p.getChannelIDFromConfig(teamsChannels)
+		if err != nil {
+			return channelsID, err
 		}
-		channelsID = append(channelsID, channel.Id)
+		channelsID = append(channelsID, channelID)
 	}
 	return channelsID, nil
 }
+
+// getChannelIDFromConfig return the id of a channel written TeamName/ChannelName
+func (p *Plugin) getChannelIDFromConfig(teamChannel string) (string, error) {
+	v := strings.Split(teamChannel, "/")
+	if len(v) != 2 {
+		return "", fmt.Errorf("Bad formatted TeamsChannels: %v", teamChannel)
+	}
+	teamName := v[0]
+	channelName := v[1]
+	team, errC := p.API.GetTeamByName(teamName)
+	if errC != nil {
+		return "", fmt.Errorf("Unable to find team with configured team: %v", teamName)
+	}
+	channel, errC := p.API.GetChannelByName(team.Id, channelName, false)
+	if errC != nil {
+		return "", fmt.Errorf("Unable to find channel with configured channel: %v", channelName)
+	}
+	return channel.Id, nil
+}
@@ -11,27 +11,66 @@ type Cron struct {
 	c *cron.Cron
 }
 
-// NewCron return a cron
-func NewCron(p *Plugin) (*Cron, error) {
+// NewCron return a cron, reports are sent as planned by schedules
+func NewCron(p *Plugin, schedules []*reportSchedule) (*Cron, error) {
 	c := cron.New()
 
-	if err := c.AddFunc("@every 1m", func() { // Run once a week, midnight between Sat/Sun
+	if err := c.AddFunc("@every 1m", func() { // Run once a minute, to count threads of replies, save data, send a heartbeat, renew the leader lock and poll reactions and deletions
+		p.flushReplies()
 		if err := p.saveCurrentAnalytic(); err != nil {
 			p.API.LogError("can't save current analytic", "err", err.Error())
 		}
+		if err := p.heartbeat(); err != nil {
+			p.API.LogError("can't send heartbeat", "err", err.Error())
+		}
+		if p.acquireLeadership() {
+			p.pollPosts()
+		}
 	}); err != nil {
 		return nil, err
 	}
 
-	if err := c.AddFunc("@weekly", func() { // Run once a week, midnight between Sat/Sun
-		if err := p.sendAnalytics(p.ChannelsID); err != nil {
-			p.API.LogError("can't send post", "err", err.Error())
+	// buckets start on utc hours, the hourly job must too in time zones with a half hour offset
+	hourly, err := parseSchedule("@hourly", "UTC")
+	if err != nil {
+		return nil, err
+	}
+	c.Schedule(hourly, cron.FuncJob(func() { // Run once an hour, to close the bucket of the last hour
+		p.flushReplies()
+		p.rolloverBucket()
+		if err := p.registerNode(); err != nil {
+			p.API.LogError("can't register node", "err", err.Error())
+		}
+		p.getResolver().sweep()
+		if p.acquireLeadership() {
+			p.mergePartials()
+		}
+	}))
+
+	if err := c.AddFunc("@daily", func() { // Run once a day, midnight
+		if p.acquireLeadership() {
+			p.applyRetention()
 		}
-		p.newSession()
 	}); err != nil {
 		return nil, err
 	}
 
+	digest, err := parseSchedule(digestSchedule, p.getConfiguration().ReportTimeZone)
+	if err != nil {
+		return nil, err
+	}
+	c.Schedule(digest, cron.FuncJob(p.runDigests)) // Run every monday, to send personal digests
+
+	for _, schedule := range schedules {
+		schedule := schedule
+		if len(schedule.channelsID) == 0 {
+			continue
+		}
+		c.Schedule(schedule.schedule, cron.FuncJob(func() { // Run as configured in ReportSchedule or ChannelsSchedules
+			p.runSchedule(schedule)
+		}))
+	}
+
 	c.Start()
 
 	return &Cron{
@@ -42,6 +81,7 @@ func NewCron(p *Plugin) (*Cron, error) {
 
 // Stop the cron task and save data
 func (c *Cron) Stop() {
+	c.p.flushReplies()
 	if err := c.p.saveCurrentAnalytic(); err != nil {
 		c.p.API.LogError("can't save current analytic", "err", err.Error())
 	}
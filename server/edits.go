@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+// countEdit add an edited post in an analytic, caller must hold the write lock
+func countEdit(a *Analytic, post *model.Post) {
+	a.UsersEdits[post.UserId]++
+	a.ChannelsEdits[post.ChannelId]++
+	incrementChannelUser(a.ChannelsUsersEdits, post.ChannelId, post.UserId)
+}
+
+// countDelete add a deleted post in an analytic, it is counted for its author, caller must hold the write lock
+func countDelete(a *Analytic, post *model.Post) {
+	a.UsersDeletes[post.UserId]++
+	a.ChannelsDeletes[post.ChannelId]++
+	incrementChannelUser(a.ChannelsUsersDeletes, post.ChannelId, post.UserId)
+}
+
+// uncountPost remove a deleted post from an analytic, caller must hold the write lock
+// it removes what countPost, countSource and countHeatmap added
+// files stay in FilesNb and FilesSize, they were uploaded anyway, and threads keep their replies and response times
+func uncountPost(a *Analytic, post *model.Post, filesSize int64, source string, location *time.Location) {
+	addPost(a, post, filesSize, -1)
+	a.Sources[source]--
+	addChannelUser(a.ChannelsSources, post.ChannelId, source, -1)
+	key := heatmapKey(time.Unix(0, post.CreateAt*int64(time.Millisecond)).In(location))
+	a.Heatmap[key]--
+	addChannelUser(a.ChannelsHeatmap, post.ChannelId, key, -1)
+}
+
+// deletedPost is what is removed from counters when a deleted post is subtracted
+type deletedPost struct {
+	post      *model.Post
+	source    string
+	teamID    string
+	filesSize int64
+	location  *time.Location
+}
+
+// uncount remove the deleted post from an analytic, caller must hold the write lock
+func (d *deletedPost) uncount(a *Analytic) {
+	uncountPost(a, d.post, d.filesSize, d.source, d.location)
+	countTeam(a, d.post, d.teamID, -1)
+}
+
+// countDeletion count a post deleted since the last poll in the current bucket
+// with SubtractDeletedPosts, the post is also removed from the bucket of the hour it was created in
+// posts of sources which aren't counted are ignored, they were never counted
+func (p *Plugin) countDeletion(post *model.Post) {
+	config := p.getConfiguration()
+	source := p.getPostSource(post)
+	if !config.isCounted(source) {
+		return
+	}
+	created := time.Unix(0, post.CreateAt*int64(time.Millisecond))
+	var deleted *deletedPost
+	if config.SubtractDeletedPosts {
+		deleted = &deletedPost{
+			post:      post,
+			source:    source,
+			teamID:    p.getPostTeamID(post),
+			filesSize: p.getFilesSize(post.FileIds),
+			location:  config.getHeatmapLocation(),
+		}
+	}
+
+	p.currentAnalytic.WLock()
+	countDelete(p.currentAnalytic, post)
+	inCurrent := !created.Before(p.currentAnalytic.Start)
+	if deleted != nil && inCurrent {
+		deleted.uncount(p.currentAnalytic)
+	}
+	p.currentAnalytic.WUnlock()
+
+	if deleted != nil && !inCurrent {
+		if err := p.subtractClosedPost(deleted, created); err != nil {
+			p.API.LogError("can't subtract deleted post", "postID", post.Id, "err", err.Error())
+		}
+	}
+}
+
+// deletedPartialKey is the partial where deleted posts of a closed hour are subtracted
+// it's merged with the closed bucket of this hour like partials of nodes
+func (p *Plugin) deletedPartialKey(start time.Time) string {
+	return fmt.Sprintf("%s%s-%d-deleted", partialPrefix, p.nodeID, start.Unix())
+}
+
+// subtractClosedPost remove a deleted post from the closed hour it was created in
+// posts of hours which weren't recorded are ignored: older than the retention, than the plugin
+// or posted while it was stopped, else the hour would get a bucket with only negative counts
+func (p *Plugin) subtractClosedPost(deleted *deletedPost, created time.Time) error {
+	retentionDays := p.getConfiguration().getRetentionDays()
+	if retentionDays > 0 && created.Before(time.Now().AddDate(0, 0, -retentionDays)) {
+		return nil
+	}
+
+	// mergePartials must not merge the partial between its load and its save
+	p.historyLock.Lock()
+	defer p.historyLock.Unlock()
+
+	start := bucketStart(created)
+	recorded, err := p.isRecorded(created)
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		return nil
+	}
+	key := p.deletedPartialKey(start)
+	partial, err := p.loadKey(key)
+	if err != nil {
+		return err
+	}
+	if partial == nil {
+		partial = NewAnalytic()
+		partial.Start = start
+		partial.End = start.Add(bucketDuration)
+	}
+	deleted.uncount(partial)
+
+	j, err := encodeAnalytic(partial)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal deleted partial")
+	}
+	if appErr := p.API.KVSet(key, j); appErr != nil {
+		return errors.Wrap(appErr, "can't save deleted partial")
+	}
+	if err := p.indexPartial(key); err != nil {
+		p.API.LogError("can't index deleted partial, it will be indexed with the next one", "err", err.Error())
+	}
+	return nil
+}
+
+// isRecorded return true if the hour containing t has a closed bucket or a partial of a node
+// caller must hold historyLock so partials are not merged meanwhile
+func (p *Plugin) isRecorded(t time.Time) (bool, error) {
+	index, err := p.bucketsIndex()
+	if err != nil {
+		return false, err
+	}
+	for _, ref := range index {
+		if !t.Before(ref.Start) && t.Before(ref.End) {
+			return true, nil
+		}
+	}
+
+	keys, err := p.openKeys()
+	if err != nil {
+		return false, err
+	}
+	start := fmt.Sprintf("-%d", bucketStart(t).Unix())
+	for _, key := range keys {
+		if isPartialKey(key) && (strings.HasSuffix(key, start) || strings.HasSuffix(key, start+"-deleted")) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
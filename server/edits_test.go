@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountEditsAndDeletes(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAnalytic()
+	post := &model.Post{Id: "post1", UserId: "user1", ChannelId: "chan1", ParentId: "root", FileIds: []string{"file1"}}
+	countPost(a, post, 10)
+	countSource(a, post, sourceHuman)
+	countHeatmap(a, post, time.UTC)
+	countPost(a, &model.Post{Id: "post2", UserId: "user1", ChannelId: "chan1"}, 0)
+	countEdit(a, post)
+	countDelete(a, post)
+	uncountPost(a, post, 10, sourceHuman, time.UTC)
+
+	assert.Equal(int64(1), a.Channels["chan1"])
+	assert.Equal(int64(0), a.ChannelsReply["chan1"])
+	assert.Equal(int64(1), a.ChannelsUsers["chan1"]["user1"])
+	assert.Equal(int64(0), a.ChannelsFilesNb["chan1"])
+	assert.Equal(int64(0), a.UsersFilesSize["user1"])
+	assert.Equal(int64(0), a.Sources[sourceHuman])
+	assert.Equal(int64(0), a.Heatmap[heatmapKey(time.Unix(0, 0).UTC())])
+	assert.Equal(int64(1), a.UsersEdits["user1"])
+	assert.Equal(int64(1), a.ChannelsDeletes["chan1"])
+
+	filtered := a.FilterChannels(func(channelID string) bool { return channelID == "chan1" })
+	assert.Equal(int64(1), filtered.UsersEdits["user1"])
+	assert.Equal(int64(1), filtered.UsersDeletes["user1"])
+	assert.Equal(int64(50), percentOf(1, 2))
+	assert.Equal(int64(0), percentOf(1, 0))
+}
+
+func TestIsRecorded(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+	index, err := json.Marshal([]bucketRef{{Start: start, End: start.Add(bucketDuration)}})
+	assert.Nil(err)
+	partial := start.Add(2 * bucketDuration)
+	p := &Plugin{nodeID: "node1"}
+	p.API = &kvAPI{kv: map[string][]byte{
+		bucketsIndexKey:              index,
+		nodesKey:                     []byte(`["node1"]`),
+		openPartialsPrefix + "node1": []byte(fmt.Sprintf(`["partial-node1-%d"]`, partial.Unix())),
+	}}
+
+	for _, test := range []struct {
+		created  time.Time
+		recorded bool
+	}{
+		{start.Add(-time.Minute), false},
+		{start.Add(30 * time.Minute), true},
+		{start.Add(bucketDuration), false},
+		{partial.Add(time.Minute), true},
+	} {
+		recorded, err := p.isRecorded(test.created)
+		assert.Nil(err)
+		assert.Equal(test.recorded, recorded, test.created.String())
+	}
+}
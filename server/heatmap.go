@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	chart "github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+)
+
+const (
+	heatmapChart = "heatmap"
+	// heatmapColor is the color of the busiest hour, the color of report attachments
+	heatmapColor = "FF8000"
+)
+
+// heatmapKey return the key of the weekday and hour of t in the heatmap, like 1-14 for monday 14:00
+func heatmapKey(t time.Time) string {
+	return fmt.Sprintf("%d-%d", t.Weekday(), t.Hour())
+}
+
+// countHeatmap add a post in the heatmap of an analytic, caller must hold the write lock
+// the weekday and hour are the ones of the time zone of the heatmap when the post was counted
+func countHeatmap(a *Analytic, post *model.Post, location *time.Location) {
+	key := heatmapKey(time.Unix(0, post.CreateAt*int64(time.Millisecond)).In(location))
+	a.Heatmap[key]++
+	incrementChannelUser(a.ChannelsHeatmap, post.ChannelId, key)
+}
+
+// heatmapValues return messages by weekday and hour, sunday first, in the order of heatmapKey
+func heatmapValues(heatmap map[string]int64) []float64 {
+	values := make([]float64, 7*24)
+	for day := 0; day < 7; day++ {
+		for hour := 0; hour < 24; hour++ {
+			values[day*24+hour] = float64(heatmap[fmt.Sprintf("%d-%d", day, hour)])
+		}
+	}
+	return values
+}
+
+// busiestHour return the weekday and hour with the most messages, false when there is no message
+func busiestHour(values []float64) (time.Weekday, int, bool) {
+	max := 0
+	for index, value := range values {
+		if value > values[max] {
+			max = index
+		}
+	}
+	if len(values) == 0 || values[max] == 0 {
+		return 0, 0, false
+	}
+	return time.Weekday(max / 24), max % 24, true
+}
+
+// getHeatmapFields draw messages by weekday and hour and tell the busiest hour
+func (p *Plugin) getHeatmapFields(siteURL string, heatmap map[string]int64) ([]*model.SlackAttachmentField, error) {
+	values := heatmapValues(heatmap)
+	day, hour, ok := busiestHour(values)
+	if !ok {
+		return nil, nil
+	}
+	m := fmt.Sprintf("### Activity\n#### The busiest hour is **%s %02d:00-%02d:00** *(%s)*.\n", day, hour, hour+1, p.getConfiguration().getHeatmapLocation())
+	urlChart, err := p.saveChart(siteURL, &chartSpec{Kind: heatmapChart, Values: values})
+	if err != nil {
+		return nil, err
+	}
+	return buildSlackAttachmentField(m, "activity heatmap", urlChart), nil
+}
+
+// renderHeatmap draw a grid of weekdays by hours, darker cells have more messages
+func (p *Plugin) renderHeatmap(w http.ResponseWriter, format chartFormat, values []float64) error {
+	if len(values) != 7*24 {
+		return fmt.Errorf("Heatmap needs %d values, got %d", 7*24, len(values))
+	}
+	width, height := format.size(800, 260)
+	r, err := format.provider(width, height)
+	if err != nil {
+		return err
+	}
+	if format.dpi > 0 {
+		r.SetDPI(format.dpi)
+	}
+	font, err := chart.GetDefaultFont()
+	if err != nil {
+		return err
+	}
+	r.SetFont(font)
+	r.SetFontColor(drawing.ColorBlack)
+	r.SetFontSize(10 * format.scale)
+
+	max := 0.0
+	for _, value := range values {
+		if value > max {
+			max = value
+		}
+	}
+	left, top := int(40*format.scale), int(20*format.scale)
+	cellWidth := (width - left) / 24
+	cellHeight := (height - top) / 7
+	color := drawing.ColorFromHex(heatmapColor)
+
+	for hour := 0; hour < 24; hour += 3 {
+		r.Text(fmt.Sprintf("%02dh", hour), left+hour*cellWidth, top-int(6*format.scale))
+	}
+	for day := 0; day < 7; day++ {
+		y := top + day*cellHeight
+		r.Text(time.Weekday(day).String()[:3], 0, y+cellHeight/2+int(4*format.scale))
+		for hour := 0; hour < 24; hour++ {
+			x := left + hour*cellWidth
+			alpha := uint8(0)
+			if max > 0 {
+				alpha = uint8(255 * values[day*24+hour] / max)
+			}
+			r.SetFillColor(color.WithAlpha(alpha))
+			r.SetStrokeColor(drawing.ColorWhite)
+			r.SetStrokeWidth(1)
+			r.MoveTo(x, y)
+			r.LineTo(x+cellWidth, y)
+			r.LineTo(x+cellWidth, y+cellHeight)
+			r.LineTo(x, y+cellHeight)
+			r.Close()
+			r.FillStroke()
+		}
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	return r.Save(w)
+}
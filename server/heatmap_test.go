@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeatmap(t *testing.T) {
+	assert := assert.New(t)
+
+	paris, err := time.LoadLocation("Europe/Paris")
+	assert.Nil(err)
+	// monday 2019-03-04 23:30 UTC is tuesday 00:30 in Paris
+	created := time.Date(2019, 3, 4, 23, 30, 0, 0, time.UTC)
+	post := &model.Post{ChannelId: "chan1", CreateAt: created.UnixNano() / int64(time.Millisecond)}
+
+	a := NewAnalytic()
+	countHeatmap(a, post, paris)
+	countHeatmap(a, post, time.UTC)
+	assert.Equal(int64(1), a.Heatmap["2-0"])
+	assert.Equal(int64(1), a.ChannelsHeatmap["chan1"]["1-23"])
+
+	values := heatmapValues(a.Heatmap)
+	assert.Len(values, 7*24)
+	assert.Equal(1.0, values[2*24])
+	day, hour, ok := busiestHour(values)
+	assert.True(ok)
+	assert.Equal(time.Monday, day)
+	assert.Equal(23, hour)
+
+	_, _, ok = busiestHour(heatmapValues(nil))
+	assert.False(ok)
+}
@@ -8,16 +8,70 @@ import (
 )
 
 // MessageHasBeenPosted is called by mattermost when a message has been posted
-// used to store metrics on messages
+// used to store metrics on messages, posts of integrations are only counted by source by default
 func (p *Plugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post) {
+	p.invalidateChannel(post)
+	source := p.getPostSource(post)
+	if !p.getConfiguration().isCounted(source) {
+		p.currentAnalytic.WLock()
+		countSource(p.currentAnalytic, post, source)
+		p.currentAnalytic.WUnlock()
+		return
+	}
+	filesSize := p.getFilesSize(post.FileIds)
+	teamID := p.getPostTeamID(post)
+	if post.ParentId != "" || post.RootId != "" {
+		p.queueReply(post)
+	}
+
+	p.currentAnalytic.WLock()
+	defer p.currentAnalytic.WUnlock()
+
+	countSource(p.currentAnalytic, post, source)
+	countPost(p.currentAnalytic, post, filesSize)
+	countTeam(p.currentAnalytic, post, teamID, 1)
+	countHeatmap(p.currentAnalytic, post, p.getConfiguration().getHeatmapLocation())
+}
+
+// MessageHasBeenUpdated is called by mattermost when a message has been updated
+// used to count edits, other updates like pinning a post keep the same message
+func (p *Plugin) MessageHasBeenUpdated(c *plugin.Context, newPost *model.Post, oldPost *model.Post) {
+	if newPost.Message == oldPost.Message || !p.getConfiguration().isCounted(p.getPostSource(newPost)) {
+		return
+	}
+
 	p.currentAnalytic.WLock()
 	defer p.currentAnalytic.WUnlock()
 
-	p.currentAnalytic.Users[post.UserId]++
-	p.currentAnalytic.Channels[post.ChannelId]++
+	countEdit(p.currentAnalytic, newPost)
+}
+
+// countPost add metrics of a post in an analytic, caller must hold the write lock
+// it's shared by live counting and backfill so both record the same metrics
+func countPost(a *Analytic, post *model.Post, filesSize int64) {
+	addPost(a, post, filesSize, 1)
+}
+
+// addPost add nb times metrics of a post in an analytic, nb is -1 to remove a deleted post
+// caller must hold the write lock
+func addPost(a *Analytic, post *model.Post, filesSize int64, nb int64) {
+	a.Users[post.UserId] += nb
+	a.Channels[post.ChannelId] += nb
+	addChannelUser(a.ChannelsUsers, post.ChannelId, post.UserId, nb)
 	if post.ParentId != "" {
-		p.currentAnalytic.UsersReply[post.UserId]++
-		p.currentAnalytic.ChannelsReply[post.ChannelId]++
+		a.UsersReply[post.UserId] += nb
+		a.ChannelsReply[post.ChannelId] += nb
+		addChannelUser(a.ChannelsUsersReply, post.ChannelId, post.UserId, nb)
+	}
+	if len(post.FileIds) > 0 {
+		filesNb := nb * int64(len(post.FileIds))
+		filesSize *= nb
+		a.ChannelsFilesNb[post.ChannelId] += filesNb
+		a.ChannelsFilesSize[post.ChannelId] += filesSize
+		a.UsersFilesNb[post.UserId] += filesNb
+		a.UsersFilesSize[post.UserId] += filesSize
+		addChannelUser(a.ChannelsUsersFilesNb, post.ChannelId, post.UserId, filesNb)
+		addChannelUser(a.ChannelsUsersFilesSize, post.ChannelId, post.UserId, filesSize)
 	}
 }
 
@@ -31,3 +85,18 @@ func (p *Plugin) FileWillBeUploaded(c *plugin.Context, info *model.FileInfo, fil
 	p.currentAnalytic.FilesSize += info.Size
 	return info, ""
 }
+
+// getFilesSize return the weight of all files attached to a post
+// file info doesn't know its channel on upload, so files are attributed to channels when posted
+func (p *Plugin) getFilesSize(fileIds []string) int64 {
+	size := int64(0)
+	for _, fileID := range fileIds {
+		info, err := p.API.GetFileInfo(fileID)
+		if err != nil {
+			p.API.LogWarn("can't get file info", "fileID", fileID, "err", err.Error())
+			continue
+		}
+		size += info.Size
+	}
+	return size
+}
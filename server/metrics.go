@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	metricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	// metricsDMChannel is the label of all direct and group messages, like the DM line of reports
+	metricsDMChannel = "DM"
+)
+
+// metricsLabels identify a series, written in the order of names
+type metricsLabels struct {
+	names  []string
+	values []string
+}
+
+func (l metricsLabels) String() string {
+	if len(l.names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(l.names))
+	for i, name := range l.names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(l.values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabelValue escape a label value as required by openmetrics text format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// metricsFamily is a metric with all its series
+type metricsFamily struct {
+	name       string
+	metricType string
+	help       string
+	unit       string
+	series     map[string]int64
+}
+
+func newMetricsFamily(name string, metricType string, unit string, help string) *metricsFamily {
+	return &metricsFamily{name: name, metricType: metricType, unit: unit, help: help, series: make(map[string]int64)}
+}
+
+func (f *metricsFamily) add(labels metricsLabels, value int64) {
+	f.series[labels.String()] += value
+}
+
+// write the family in openmetrics text format, series are sorted so the output is stable
+func (f *metricsFamily) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.metricType)
+	if f.unit != "" {
+		fmt.Fprintf(b, "# UNIT %s %s\n", f.name, f.unit)
+	}
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, f.help)
+	suffix := ""
+	if f.metricType == "counter" {
+		suffix = "_total"
+	}
+	labels := make([]string, 0, len(f.series))
+	for l := range f.series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		fmt.Fprintf(b, "%s%s%s %d\n", f.name, suffix, l, f.series[l])
+	}
+}
+
+// handleMetrics export metrics of the current hour in openmetrics format
+// they are gauges: they restart from zero each hour and decrease when deleted posts are subtracted
+func (p *Plugin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	token := p.getConfiguration().MetricsToken
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if given == "" {
+		given = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	metrics := p.buildMetrics()
+	w.Header().Set("Content-Type", metricsContentType)
+	if _, err := w.Write([]byte(metrics)); err != nil {
+		p.API.LogError("can't write metrics", "err", err.Error())
+	}
+}
+
+// buildMetrics export buckets of the current hour of all nodes of a cluster, so any node gives the same values
+func (p *Plugin) buildMetrics() string {
+	pe := period{since: bucketStart(time.Now())}
+	current := p.loadHistory(pe.since).between(pe)
+
+	start := newMetricsFamily("analytics_bucket_start_seconds", "gauge", "seconds", "Start of the current hour, other metrics restart from zero at each hour.")
+	messages := newMetricsFamily("analytics_messages", "gauge", "", "Messages posted by channel during the current hour.")
+	replies := newMetricsFamily("analytics_replies", "gauge", "", "Replies posted by channel during the current hour.")
+	teamMessages := newMetricsFamily("analytics_team_messages", "gauge", "", "Messages posted by team during the current hour.")
+	teamReplies := newMetricsFamily("analytics_team_replies", "gauge", "", "Replies posted by team during the current hour.")
+	files := newMetricsFamily("analytics_files", "gauge", "", "Files uploaded during the current hour.")
+	filesSize := newMetricsFamily("analytics_files_size_bytes", "gauge", "bytes", "Weight of files uploaded during the current hour.")
+	activeUsers := newMetricsFamily("analytics_active_users", "gauge", "", "Users who posted at least one message during the current hour.")
+	families := []*metricsFamily{start, messages, replies, teamMessages, teamReplies, files, filesSize, activeUsers}
+
+	start.add(metricsLabels{}, current.Start.Unix())
+	files.add(metricsLabels{}, current.FilesNb)
+	filesSize.add(metricsLabels{}, current.FilesSize)
+	activeUsers.add(metricsLabels{}, int64(len(current.Users)))
+
+	for channelID, nb := range current.Channels {
+		team, channel := p.getChannelMetricsLabels(channelID)
+		labels := metricsLabels{names: []string{"team", "channel"}, values: []string{team, channel}}
+		messages.add(labels, nb)
+		replies.add(labels, current.ChannelsReply[channelID])
+		if team != "" {
+			teamLabels := metricsLabels{names: []string{"team"}, values: []string{team}}
+			teamMessages.add(teamLabels, nb)
+			teamReplies.add(teamLabels, current.ChannelsReply[channelID])
+		}
+	}
+
+	// users are named like in reports, opted out users are left out
+	data := newPreparedData(nil)
+	if p.getConfiguration().MetricsByUser && !p.getUserPrivacy(data).hidden {
+		userMessages := newMetricsFamily("analytics_user_messages", "gauge", "", "Messages posted by user during the current hour.")
+		userReplies := newMetricsFamily("analytics_user_replies", "gauge", "", "Replies posted by user during the current hour.")
+		families = append(families, userMessages, userReplies)
+		for userID, nb := range current.Users {
+			user := p.resolveUser(data, userID)
+			if !data.privacy.ranked(user) {
+				continue
+			}
+			labels := metricsLabels{names: []string{"user"}, values: []string{user.name}}
+			userMessages.add(labels, nb)
+			userReplies.add(labels, current.UsersReply[userID])
+		}
+	}
+
+	b := &strings.Builder{}
+	for _, family := range families {
+		family.write(b)
+	}
+	b.WriteString("# EOF\n")
+	return b.String()
+}
+
+// getChannelMetricsLabels return team and channel names of a channel
+// direct and group messages are all labelled DM without team, to keep the number of series low
+// private channels are merged in one channel of their team, like in reports of a public channel
+// channels which can't be fetched are labelled unknown without team
+func (p *Plugin) getChannelMetricsLabels(channelID string) (string, string) {
+	channel, err := p.getChannel(channelID)
+	if err != nil {
+		p.API.LogWarn("can't resolve channel, counted as unknown", "channelID", channelID, "err", err.Error())
+		return "", unresolvedChannelName
+	}
+	if channel.IsGroupOrDirect() {
+		return "", metricsDMChannel
+	}
+	team, err := p.getTeam(channel.TeamId)
+	if err != nil {
+		p.API.LogWarn("can't resolve team, counted as unknown", "teamID", channel.TeamId, "err", err.Error())
+		return "", unresolvedChannelName
+	}
+	if !newChannelViewer("").canSee(channel) {
+		return team.Name, dmOrPrivateChannelName
+	}
+	return team.Name, channel.Name
+}
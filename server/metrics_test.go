@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsFamily(t *testing.T) {
+	assert := assert.New(t)
+
+	family := newMetricsFamily("analytics_messages", "counter", "", "Messages posted by channel.")
+	family.add(metricsLabels{names: []string{"team", "channel"}, values: []string{"team1", "town-square"}}, 2)
+	family.add(metricsLabels{names: []string{"team", "channel"}, values: []string{"team1", `a"b\c`}}, 1)
+	family.add(metricsLabels{names: []string{"team", "channel"}, values: []string{"team1", "town-square"}}, 3)
+
+	b := &strings.Builder{}
+	family.write(b)
+	assert.Equal(`# TYPE analytics_messages counter
+# HELP analytics_messages Messages posted by channel.
+analytics_messages_total{team="team1",channel="a\"b\\c"} 1
+analytics_messages_total{team="team1",channel="town-square"} 5
+`, b.String())
+
+	gauge := newMetricsFamily("analytics_bucket_start_seconds", "gauge", "seconds", "Start of the bucket.")
+	gauge.add(metricsLabels{}, 1556000000)
+	b = &strings.Builder{}
+	gauge.write(b)
+	assert.Equal(`# TYPE analytics_bucket_start_seconds gauge
+# UNIT analytics_bucket_start_seconds seconds
+# HELP analytics_bucket_start_seconds Start of the bucket.
+analytics_bucket_start_seconds 1556000000
+`, b.String())
+}
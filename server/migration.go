@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// migration upgrade a decoded payload from a version to the next one
+type migration func(payload map[string]interface{}) error
+
+// migrations is the registry of all migrations, indexed by the version they upgrade from
+// to change the shape of a stored Analytic, append a migration here
+// new counters need no migration and keep the version, their maps are set by normalizeAnalytic
+var migrations = []migration{
+	addedCounters, // channels breakdowns missing in payloads recorded by 0.2.0
+}
+
+// analyticVersion is the version of the format used to store an Analytic in kv
+var analyticVersion = len(migrations)
+
+// storedAnalytic is the format used to store an Analytic in kv
+type storedAnalytic struct {
+	Version int
+	*Analytic
+}
+
+// encodeAnalytic marshal an analytic with the current version, caller must hold the read lock
+func encodeAnalytic(a *Analytic) ([]byte, error) {
+	return json.Marshal(storedAnalytic{Version: analyticVersion, Analytic: a})
+}
+
+// decodeAnalytic unmarshal an analytic of any known version, upgrading it step by step
+// payloads of the current version are unmarshalled directly
+func decodeAnalytic(j []byte) (*Analytic, error) {
+	var header struct {
+		Version int
+	}
+	if err := json.Unmarshal(j, &header); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal analytic")
+	}
+	if header.Version > analyticVersion {
+		return nil, fmt.Errorf("analytic version %d is newer than supported version %d", header.Version, analyticVersion)
+	}
+	if header.Version < analyticVersion {
+		migrated, err := migratePayload(j, header.Version)
+		if err != nil {
+			return nil, err
+		}
+		j = migrated
+	}
+
+	stored := storedAnalytic{Analytic: NewAnalytic()}
+	if err := json.Unmarshal(j, &stored); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal analytic")
+	}
+	normalizeAnalytic(stored.Analytic)
+	return stored.Analytic, nil
+}
+
+// migratePayload upgrade a payload stored with an old version to the current one
+func migratePayload(j []byte, version int) ([]byte, error) {
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(j, &payload); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal analytic")
+	}
+	for ; version < analyticVersion; version++ {
+		if err := migrations[version](payload); err != nil {
+			return nil, errors.Wrapf(err, "can't migrate analytic from version %d", version)
+		}
+	}
+	payload["Version"] = analyticVersion
+
+	migrated, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't marshal migrated analytic")
+	}
+	return migrated, nil
+}
+
+// normalizeAnalytic set empty maps for counters missing or null in a decoded analytic
+// so that null maps never reach the counters
+func normalizeAnalytic(a *Analytic) {
+	value := reflect.ValueOf(a).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() == reflect.Map && field.IsNil() && field.CanSet() {
+			field.Set(reflect.MakeMap(field.Type()))
+		}
+	}
+}
+
+// decodeOrQuarantine decode an analytic stored under key
+// a payload which can't be decoded is copied in a quarantine key, so it's never lost by a later save
+func (p *Plugin) decodeOrQuarantine(key string, j []byte) (*Analytic, error) {
+	a, err := decodeAnalytic(j)
+	if err != nil {
+		if errQ := p.quarantine(key, j, err); errQ != nil {
+			p.API.LogError("can't quarantine analytic", "key", key, "err", errQ.Error())
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// quarantine copy a payload stored under key which can't be decoded
+// the quarantine key depends on the payload so the same payload is never copied twice
+func (p *Plugin) quarantine(key string, j []byte, reason error) error {
+	sum := sha1.Sum(j)
+	quarantineKey := fmt.Sprintf("quarantine-%x", sum[:16])
+	if err := p.API.KVSet(quarantineKey, j); err != nil {
+		return errors.Wrap(err, "can't save quarantine")
+	}
+	p.API.LogError("analytic can't be decoded and is quarantined", "key", key, "quarantineKey", quarantineKey, "err", reason.Error())
+	return nil
+}
+
+// addedCounters is the migration of a version which only added counters, set by normalizeAnalytic
+func addedCounters(payload map[string]interface{}) error {
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeAnalytic(t *testing.T) {
+	assert := assert.New(t)
+
+	// payload recorded by 0.2.0, without version nor channels breakdowns
+	a, err := decodeAnalytic([]byte(`{"Start":"2019-03-01T10:00:00Z","End":"0001-01-01T00:00:00Z","Channels":{"chan1":2},"ChannelsReply":null,"Users":{"user1":2},"UsersReply":{},"FilesNb":1,"FilesSize":10}`))
+	assert.Nil(err)
+	assert.Equal(time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC), a.Start.UTC())
+	assert.Equal(int64(2), a.Channels["chan1"])
+	assert.Equal(int64(1), a.FilesNb)
+	assert.NotNil(a.ChannelsReply)
+	assert.NotNil(a.ChannelsUsers)
+	assert.NotNil(a.Emojis)
+	assert.NotNil(a.ChannelsReactionsGiven)
+
+	j, err := encodeAnalytic(a)
+	assert.Nil(err)
+	assert.Contains(string(j), fmt.Sprintf(`"Version":%d`, analyticVersion))
+	b, err := decodeAnalytic(j)
+	assert.Nil(err)
+	assert.Equal(a.Channels, b.Channels)
+
+	c, err := decodeAnalytic([]byte(fmt.Sprintf(`{"Version":%d,"Teams":null,"ChannelsUsersFilesNb":null}`, analyticVersion)))
+	assert.Nil(err)
+	assert.NotNil(c.Teams)
+	assert.NotNil(c.ChannelsUsersFilesNb)
+
+	assert.Equal(1, analyticVersion)
+	_, err = decodeAnalytic([]byte(`{"Version":99}`))
+	assert.EqualError(err, fmt.Sprintf("analytic version 99 is newer than supported version %d", analyticVersion))
+
+	_, err = decodeAnalytic([]byte(`not json`))
+	assert.NotNil(err)
+}
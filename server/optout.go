@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// optedOutUsersKey stores ids of users who opted out of rankings
+	optedOutUsersKey = "optedOutUsers"
+	// pseudonymSaltKey stores the secret pseudonyms are derived from, so they are stable between reports
+	pseudonymSaltKey = "pseudonymSalt"
+	// optedOutID is the id of the line of users who opted out, dropped from rankings
+	optedOutID       = "optedOut"
+	optedOutUserName = "opted out user"
+
+	// anonymizePseudonyms and anonymizeHidden are values of AnonymizeUsers
+	anonymizePseudonyms = "pseudonyms"
+	anonymizeHidden     = "hidden"
+)
+
+// userPrivacy is what a report may tell about users, loaded once by report, see getUserPrivacy
+type userPrivacy struct {
+	optedOut map[string]bool
+	// hidden is true when user rankings are not displayed at all
+	hidden bool
+	// salt is set when users are named by pseudonyms
+	salt []byte
+}
+
+// getUserPrivacy return the privacy of users of a report, loaded on first use
+// when opt-outs can't be loaded rankings are hidden rather than naming users who may have opted out
+func (p *Plugin) getUserPrivacy(data *preparedData) *userPrivacy {
+	if data.privacy != nil {
+		return data.privacy
+	}
+	mode := p.getConfiguration().AnonymizeUsers
+	privacy := &userPrivacy{hidden: mode == anonymizeHidden}
+	optedOut, err := p.loadOptedOutUsers()
+	if err != nil {
+		p.API.LogError("can't load opted out users, user rankings are hidden", "err", err.Error())
+		privacy.hidden = true
+		optedOut = make(map[string]bool)
+	}
+	privacy.optedOut = optedOut
+	if mode == anonymizePseudonyms {
+		salt, err := p.getPseudonymSalt()
+		if err != nil {
+			p.API.LogError("can't load pseudonyms, user rankings are hidden", "err", err.Error())
+			privacy.hidden = true
+		}
+		privacy.salt = salt
+	}
+	data.privacy = privacy
+	return privacy
+}
+
+// pseudonym return a stable name of a user which doesn't tell who it is
+func (privacy *userPrivacy) pseudonym(userID string) string {
+	mac := hmac.New(sha256.New, privacy.salt)
+	_, _ = mac.Write([]byte(userID))
+	return "user-" + hex.EncodeToString(mac.Sum(nil))[:10]
+}
+
+// anonymize return the line of a user as it can be displayed, the name is replaced for opted out users
+// and with pseudonyms. The id of a pseudonym line is its pseudonym so that exports don't tell who it is
+func (privacy *userPrivacy) anonymize(userID string, line analyticsData) analyticsData {
+	if privacy.optedOut[userID] {
+		return analyticsData{id: optedOutID, name: optedOutUserName, displayName: optedOutUserName, anonymous: true}
+	}
+	if privacy.salt != nil && line.id != unresolvedID {
+		name := privacy.pseudonym(userID)
+		return analyticsData{id: name, name: name, displayName: name, anonymous: true}
+	}
+	return line
+}
+
+// ranked return true when a user line can be displayed in rankings
+func (privacy *userPrivacy) ranked(line analyticsData) bool {
+	return !privacy.hidden && line.id != optedOutID
+}
+
+// loadOptedOutUsers return ids of users who opted out of rankings
+func (p *Plugin) loadOptedOutUsers() (map[string]bool, error) {
+	optedOut := make(map[string]bool)
+	j, appErr := p.API.KVGet(optedOutUsersKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get opted out users")
+	}
+	if len(j) == 0 {
+		return optedOut, nil
+	}
+	if err := json.Unmarshal(j, &optedOut); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal opted out users")
+	}
+	return optedOut, nil
+}
+
+// setOptOut remove a user from rankings, or put it back
+func (p *Plugin) setOptOut(userID string, optedOut bool) error {
+	p.optOutLock.Lock()
+	defer p.optOutLock.Unlock()
+
+	users, err := p.loadOptedOutUsers()
+	if err != nil {
+		return err
+	}
+	if optedOut {
+		users[userID] = true
+	} else {
+		delete(users, userID)
+	}
+	j, err := json.Marshal(users)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal opted out users")
+	}
+	if appErr := p.API.KVSet(optedOutUsersKey, j); appErr != nil {
+		return errors.Wrap(appErr, "can't save opted out users")
+	}
+	return nil
+}
+
+// getPseudonymSalt return the secret of pseudonyms, generated on first use
+func (p *Plugin) getPseudonymSalt() ([]byte, error) {
+	p.optOutLock.Lock()
+	defer p.optOutLock.Unlock()
+
+	salt, appErr := p.API.KVGet(pseudonymSaltKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get pseudonym salt")
+	}
+	if len(salt) > 0 {
+		return salt, nil
+	}
+	salt = []byte(model.NewId() + model.NewId())
+	if appErr := p.API.KVSet(pseudonymSaltKey, salt); appErr != nil {
+		return nil, errors.Wrap(appErr, "can't save pseudonym salt")
+	}
+	return salt, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserPrivacy(t *testing.T) {
+	assert := assert.New(t)
+	alice := analyticsData{id: "alice", name: "alice", displayName: "alice"}
+
+	privacy := &userPrivacy{optedOut: map[string]bool{"bob": true}}
+	assert.Equal(alice, privacy.anonymize("alice", alice))
+	bob := privacy.anonymize("bob", analyticsData{id: "bob", name: "bob", displayName: "bob"})
+	assert.Equal(optedOutID, bob.id)
+	assert.True(privacy.ranked(alice))
+	assert.False(privacy.ranked(bob))
+	assert.Equal("*opted out user*", getUserMention(bob))
+
+	privacy.salt = []byte("salt")
+	pseudonym := privacy.anonymize("alice", alice)
+	assert.Equal(pseudonym, privacy.anonymize("alice", alice))
+	assert.NotEqual("alice", pseudonym.id)
+	assert.Equal(pseudonym.id, pseudonym.name)
+	assert.Equal("*"+pseudonym.name+"*", getUserMention(pseudonym))
+	assert.NotEqual(pseudonym.name, (&userPrivacy{salt: []byte("other")}).pseudonym("alice"))
+	unknown := analyticsData{id: unresolvedID, name: unresolvedUserName}
+	assert.Equal(unknown, privacy.anonymize("carol", unknown))
+
+	privacy.hidden = true
+	assert.False(privacy.ranked(alice))
+}
+
+func TestCountUsers(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, countUsers(nil, nil))
+	assert.Equal(3, countUsers(map[string]int64{"a": 2, "b": 0, "c": 1}, map[string]int64{"a": 1, "d": 1, "e": 0}))
+}
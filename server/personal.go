@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// digestSubscribersKey stores ids of users who opted in the weekly digest
+	digestSubscribersKey = "digestSubscribers"
+	// digestSchedule is when digests are sent, in the time zone of reports
+	digestSchedule = "0 9 * * MON"
+)
+
+// buildPersonalAttachments return the analytics of a user, only displayed to this user
+// private channels the user has left since posting in them are not named, like in other reports
+func (p *Plugin) buildPersonalAttachments(pe period, userID string) ([]*model.SlackAttachment, error) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+
+	pe = pe.withDefaultSince(defaultReportDuration)
+	since := trendsPeriod(pe).since
+	if previousPeriod(pe).since.Before(since) {
+		since = previousPeriod(pe).since
+	}
+	h := p.loadHistory(since)
+	a := h.between(pe)
+	memberChannels, err := p.getMemberChannels(userID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := p.prepareUserData(a, userID, newMemberViewer(memberChannels))
+	if err != nil {
+		return nil, err
+	}
+	user := data.users[0]
+	previous := h.between(previousPeriod(pe))
+
+	a.RLock()
+	text := fmt.Sprintf("## Your analytics %s.\n", formatPeriod(a))
+	filesNb := a.UsersFilesNb[userID]
+	filesSize := a.UsersFilesSize[userID]
+	a.RUnlock()
+	previous.RLock()
+	previousNb := previous.Users[userID]
+	previous.RUnlock()
+
+	if user.nb > 0 {
+		text += fmt.Sprintf("#### You sent **%d messages** in **%d channels**. **%d** *(%d%%)* of the messages were replies.\n", user.nb, len(data.channels), user.reply, percentOf(user.reply, user.nb))
+	} else {
+		text += "#### You didn't send any message.\n"
+	}
+	if filesNb > 0 {
+		text += fmt.Sprintf("#### You shared **%d files** for a total size of **%s**.\n", filesNb, byteCountDecimal(filesSize))
+	}
+	text += fmt.Sprintf("#### %s\n", formatEvolution(user.nb, previousNb))
+
+	fields := make([]*model.SlackAttachmentField, 0)
+	if len(data.channels) > 0 {
+		channelsFields, err := p.getChannelsFields(*siteURL, data)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, channelsFields...)
+	}
+	trendsFields, err := p.getPersonalTrendsFields(*siteURL, userID, trends(h, pe))
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, trendsFields...)
+	return buildAttachments(text, fields), nil
+}
+
+// previousPeriod return the period of the same duration just before pe
+func previousPeriod(pe period) period {
+	return period{since: pe.since.Add(-pe.end().Sub(pe.since)), until: pe.since}
+}
+
+// formatEvolution compare messages of a period with the previous one
+func formatEvolution(nb int64, previous int64) string {
+	switch {
+	case previous == 0 && nb == 0:
+		return "No message in the previous period either."
+	case previous == 0:
+		return "You didn't send any message in the previous period."
+	case nb >= previous:
+		return fmt.Sprintf("That's **+%d%%** compared to the previous period *(%d messages)*.", percentOf(nb-previous, previous), previous)
+	default:
+		return fmt.Sprintf("That's **-%d%%** compared to the previous period *(%d messages)*.", percentOf(previous-nb, previous), previous)
+	}
+}
+
+// getPersonalTrendsFields draw messages and replies of a user for each step
+func (p *Plugin) getPersonalTrendsFields(siteURL string, userID string, steps []*Analytic) ([]*model.SlackAttachmentField, error) {
+	if len(steps) < 2 {
+		return nil, nil
+	}
+	spec := &chartSpec{Kind: lineChart}
+	messages := chartSeries{Name: "messages"}
+	replies := chartSeries{Name: "replies"}
+	for _, step := range steps {
+		spec.Dates = append(spec.Dates, step.Start.Unix())
+		messages.Values = append(messages.Values, float64(step.Users[userID]))
+		replies.Values = append(replies.Values, float64(step.UsersReply[userID]))
+	}
+	spec.Series = []chartSeries{messages, replies}
+	urlChart, err := p.saveChart(siteURL, spec)
+	if err != nil {
+		return nil, err
+	}
+	return buildSlackAttachmentField("", "personal trends line chart", urlChart), nil
+}
+
+// loadDigestSubscribers return ids of users who opted in the digest
+func (p *Plugin) loadDigestSubscribers() (map[string]bool, error) {
+	subscribers := make(map[string]bool)
+	j, appErr := p.API.KVGet(digestSubscribersKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get digest subscribers")
+	}
+	if len(j) == 0 {
+		return subscribers, nil
+	}
+	if err := json.Unmarshal(j, &subscribers); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal digest subscribers")
+	}
+	return subscribers, nil
+}
+
+// setDigestSubscription opt a user in or out of the digest
+func (p *Plugin) setDigestSubscription(userID string, subscribed bool) error {
+	p.digestLock.Lock()
+	defer p.digestLock.Unlock()
+
+	subscribers, err := p.loadDigestSubscribers()
+	if err != nil {
+		return err
+	}
+	if subscribed {
+		subscribers[userID] = true
+	} else {
+		delete(subscribers, userID)
+	}
+	j, err := json.Marshal(subscribers)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal digest subscribers")
+	}
+	if appErr := p.API.KVSet(digestSubscribersKey, j); appErr != nil {
+		return errors.Wrap(appErr, "can't save digest subscribers")
+	}
+	return nil
+}
+
+// sendDigests send the personal report of the last week by direct message to each subscriber
+// a digest which can't be sent is logged and the others are still sent
+func (p *Plugin) sendDigests(pe period) {
+	subscribers, err := p.loadDigestSubscribers()
+	if err != nil {
+		p.API.LogError("can't send digests", "err", err.Error())
+		return
+	}
+	for userID := range subscribers {
+		if err := p.sendDigest(pe, userID); err != nil {
+			p.API.LogError("can't send digest", "userID", userID, "err", err.Error())
+		}
+	}
+}
+
+func (p *Plugin) sendDigest(pe period, userID string) error {
+	channel, appErr := p.API.GetDirectChannel(p.BotUserID, userID)
+	if appErr != nil {
+		return errors.Wrap(appErr, "can't get direct channel")
+	}
+	attachments, err := p.buildPersonalAttachments(pe, userID)
+	if err != nil {
+		return err
+	}
+	attachments[0].Pretext = fmt.Sprintf("Your weekly digest, stop it with `/%s digest off`.", CommandTrigger)
+	return p.postAttachments(channel.Id, attachments)
+}
+
+// runDigests send digests of the last week, called by cron
+func (p *Plugin) runDigests() {
+	if !p.acquireLeadership() {
+		return // another node of the cluster sends digests
+	}
+	now := time.Now()
+	if !p.claimRun("digest", dayStart(now)) {
+		return // already sent by another node
+	}
+	p.sendDigests(period{until: now}.withDefaultSince(7 * 24 * time.Hour))
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersonal(t *testing.T) {
+	assert := assert.New(t)
+
+	since := time.Date(2019, 3, 11, 0, 0, 0, 0, time.UTC)
+	previous := previousPeriod(period{since: since, until: since.AddDate(0, 0, 7)})
+	assert.Equal(since.AddDate(0, 0, -7), previous.since)
+	assert.Equal(since, previous.until)
+
+	assert.Contains(formatEvolution(15, 10), "**+50%**")
+	assert.Contains(formatEvolution(5, 10), "**-50%**")
+	assert.Contains(formatEvolution(5, 0), "didn't send any message")
+}
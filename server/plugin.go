@@ -12,7 +12,14 @@ import (
 )
 
 const (
-	dmOrPrivateChannelName = "DM"
+	// dmOrPrivateChannelName is the name of the line of direct messages and channels the viewer may not see
+	dmOrPrivateChannelName = "private channels"
+	// unresolvedID is the id of the lines of channels or users which can't be fetched
+	unresolvedID          = "unresolved"
+	unresolvedChannelName = "unknown channel"
+	unresolvedUserName    = "unknown user"
+	deletedUserName       = "deleted user"
+	archivedChannelSuffix = " (archived)"
 )
 
 // Plugin is the main struct used by mattermost to interact with this plugin
@@ -26,12 +33,50 @@ type Plugin struct {
 	// setConfiguration for usage.
 	configuration *configuration
 
+	// nodeID identifies this node of a cluster, see getNodeID
+	nodeID          string
 	currentAnalytic *Analytic
 
-	cron *Cron
+	// historyLock synchronizes changes of the closed buckets and their index.
+	historyLock sync.Mutex
+	// bucketsCacheLock synchronizes the cache of closed buckets read by reports, see cachedBucket
+	bucketsCacheLock sync.Mutex
+	bucketsCache     map[string]*Analytic
+	// partialsLock synchronizes changes of the index of partials of this node.
+	partialsLock sync.Mutex
+	// unindexedPartials are partials saved but not indexed yet, indexed with the next one
+	unindexedPartials []string
 
-	BotUserID  string
-	ChannelsID []string
+	// cronLock synchronizes the restart of the cron when the configuration changes.
+	cronLock sync.Mutex
+	cron     *Cron
+
+	// backfillLock synchronizes access to the running backfill.
+	backfillLock sync.Mutex
+	backfill     *backfillRunner
+
+	// threadsLock synchronizes changes of thread records.
+	threadsLock sync.Mutex
+	// repliesLock synchronizes the queue of replies whose thread is read by the minute job.
+	repliesLock    sync.Mutex
+	pendingReplies []*model.Post
+
+	// pollLock synchronizes polls of reactions and deletions.
+	pollLock sync.Mutex
+	poller   *postsPoller
+
+	// digestLock synchronizes changes of digest subscribers.
+	digestLock sync.Mutex
+	// optOutLock synchronizes changes of opted out users and the creation of the pseudonym salt.
+	optOutLock sync.Mutex
+
+	// resolver caches channels, teams and users, see getResolver
+	resolverOnce sync.Once
+	resolver     *nameResolver
+
+	BotUserID string
+	// schedules of reports are guarded by the configurationLock, see getSchedules
+	schedules []*reportSchedule
 }
 
 // CommandTrigger is the string used by user to interact with this plugin
@@ -47,19 +92,12 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		}, nil
 	}
 
-	if err := p.sendAnalytics([]string{args.ChannelId}); err != nil {
-		p.API.LogError("can't send analytics", "err", err.Error())
-		return &model.CommandResponse{
-			ResponseType: model.COMMAND_RESPONSE_TYPE_EPHEMERAL,
-			Text:         fmt.Sprintf("An error occured!"),
-		}, nil
-	}
-
-	return &model.CommandResponse{}, nil
+	return p.executeSubcommand(args), nil
 }
 
 // analyticsData represent a line in the final report
 // it give for a channel (or a user) : displayName, name, link, number of posts and number of reply
+// (or number of files and their weight in a files report)
 type analyticsData struct {
 	id          string
 	displayName string
@@ -67,6 +105,11 @@ type analyticsData struct {
 	link        string
 	nb          int64
 	reply       int64
+	size        int64
+	// private is true for private channels, direct messages and the anonymous private channels line
+	private bool
+	// anonymous is true for users named by a pseudonym or opted out of rankings
+	anonymous bool
 }
 
 type preparedData struct {
@@ -74,124 +117,340 @@ type preparedData struct {
 	totalMessagesPrivate int64
 	users                []analyticsData
 	channels             []analyticsData
+	filesNb              int64
+	filesSize            int64
+	// totalUsers is the number of users who sent messages, including the ones not ranked in users
+	totalUsers int
+	// edits and deletes are numbers of edited and deleted messages
+	edits   int64
+	deletes int64
+	// threads are channels lines of threads metrics, responders are users sorted by first response delay
+	threads    []threadsData
+	responders []responderData
+	// appreciated are users by reactions received in nb and given in reply, emojis are emojis by reactions
+	appreciated []analyticsData
+	emojis      []analyticsData
+	// sources are messages by source, integrations are channels by messages of integrations
+	sources      map[string]int64
+	integrations []analyticsData
+	// unresolvedChannels and unresolvedUsers are ids which couldn't be fetched, counted in the unknown lines
+	unresolvedChannels map[string]bool
+	unresolvedUsers    map[string]bool
+	// viewer is the audience of the report, channels it may not see are merged in the private channels line
+	viewer *viewer
+	// privacy tells how users are displayed, see getUserPrivacy
+	privacy *userPrivacy
 }
 
-func (p *Plugin) prepareData() (*preparedData, error) {
-	p.currentAnalytic.RLock()
-	defer p.currentAnalytic.RUnlock()
+func newPreparedData(v *viewer) *preparedData {
+	return &preparedData{
+		viewer:             v,
+		users:              make([]analyticsData, 0),
+		channels:           make([]analyticsData, 0),
+		unresolvedChannels: make(map[string]bool),
+		unresolvedUsers:    make(map[string]bool),
+	}
+}
 
-	totalMessagesPublic := int64(0)
-	totalMessagesPrivate := int64(0)
-	users := make([]analyticsData, 0)
-	channels := make([]analyticsData, 0)
-	channels = append(channels, analyticsData{id: "none", name: dmOrPrivateChannelName, displayName: dmOrPrivateChannelName, link: "", nb: 0, reply: 0})
+func (p *Plugin) prepareData(a *Analytic, v *viewer) (*preparedData, error) {
+	a.RLock()
+	defer a.RUnlock()
 
-	for key, nb := range p.currentAnalytic.Channels {
-		channelName, channelDisplayName, link, err := p.getChannelName(key)
-		if err != nil {
-			return nil, err
-		}
-		if channelName == dmOrPrivateChannelName {
-			totalMessagesPrivate += nb
-			channels[0].nb = channels[0].nb + nb
+	p.prefetchChannels(a.Channels)
+	p.prefetchUsers(a.Users)
+
+	data := newPreparedData(v)
+	data.channels = append(data.channels, newPrivateChannelsLine())
+	data.filesNb = a.FilesNb
+	data.filesSize = a.FilesSize
+
+	for key, nb := range a.Channels {
+		line := p.resolveChannel(data, key)
+		if line.private {
+			data.totalMessagesPrivate += nb
 		} else {
-			totalMessagesPublic += nb
-			channels = p.updateOrAppend(channels, analyticsData{id: key, displayName: channelDisplayName, name: channelName, link: link, nb: nb, reply: 0})
+			data.totalMessagesPublic += nb
 		}
+		line.nb = nb
+		data.channels = p.updateOrAppend(data.channels, line)
 	}
-	for key, nb := range p.currentAnalytic.ChannelsReply {
-		channelName, channelDisplayName, link, err := p.getChannelName(key)
-		if err != nil {
-			return nil, err
-		}
-		channels = p.updateOrAppend(channels, analyticsData{id: key, displayName: channelDisplayName, name: channelName, link: link, nb: 0, reply: nb})
+	for key, nb := range a.ChannelsReply {
+		line := p.resolveChannel(data, key)
+		line.reply = nb
+		data.channels = p.updateOrAppend(data.channels, line)
+	}
+	data.totalUsers = countUsers(a.Users, a.UsersReply)
+	data.users = p.prepareUsers(data, a.Users, a.UsersReply)
+	data.appreciated = p.prepareUsers(data, a.ReactionsReceived, a.ReactionsGiven)
+	for _, nb := range a.ChannelsEdits {
+		data.edits += nb
 	}
-	for key, nb := range p.currentAnalytic.Users {
-		displayKey, err := p.getUsername(key)
-		if err != nil {
-			return nil, err
+	for _, nb := range a.ChannelsDeletes {
+		data.deletes += nb
+	}
+	data.emojis = prepareEmojis(a.Emojis)
+	p.prepareIntegrations(data, a)
+	p.prepareThreads(data, a, func(string) bool { return true })
+	p.prepareResponders(data, a.UsersFirstResponses, a.UsersResponseTime)
+	sort.Slice(data.channels, func(i, j int) bool {
+		return data.channels[i].nb > data.channels[j].nb
+	})
+	return data, nil
+}
+
+// prepareEmojis build emojis lines sorted by number of reactions
+func prepareEmojis(emojis map[string]int64) []analyticsData {
+	lines := make([]analyticsData, 0, len(emojis))
+	for name, nb := range emojis {
+		lines = append(lines, analyticsData{id: name, name: name, displayName: name, nb: nb})
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].nb == lines[j].nb {
+			return lines[i].name < lines[j].name
 		}
-		users = p.updateOrAppend(users, analyticsData{id: key, displayName: displayKey, name: displayKey, nb: nb, reply: 0})
+		return lines[i].nb > lines[j].nb
+	})
+	return lines
+}
+
+// prepareChannelData is like prepareData but only with metrics of one channel
+func (p *Plugin) prepareChannelData(a *Analytic, channelID string, v *viewer) (*preparedData, error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	data := newPreparedData(v)
+	channel := p.resolveChannel(data, channelID)
+	nb := a.Channels[channelID]
+	channel.nb = nb
+	channel.reply = a.ChannelsReply[channelID]
+
+	data.totalUsers = countUsers(a.ChannelsUsers[channelID], a.ChannelsUsersReply[channelID])
+	data.users = p.prepareUsers(data, a.ChannelsUsers[channelID], a.ChannelsUsersReply[channelID])
+	data.channels = []analyticsData{channel}
+	data.filesNb = a.ChannelsFilesNb[channelID]
+	data.filesSize = a.ChannelsFilesSize[channelID]
+	data.edits = a.ChannelsEdits[channelID]
+	data.deletes = a.ChannelsDeletes[channelID]
+	p.prepareThreads(data, a, func(key string) bool { return key == channelID })
+	p.prepareResponders(data, a.ChannelsUsersFirstResponses[channelID], a.ChannelsUsersResponseTime[channelID])
+	if channel.private {
+		data.totalMessagesPrivate = nb
+	} else {
+		data.totalMessagesPublic = nb
 	}
-	for key, nb := range p.currentAnalytic.UsersReply {
-		displayKey, err := p.getUsername(key)
-		if err != nil {
-			return nil, err
+	return data, nil
+}
+
+// prepareUserData is like prepareData but only with metrics of one user
+// channels are the ones where this user sent messages
+func (p *Plugin) prepareUserData(a *Analytic, userID string, v *viewer) (*preparedData, error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	data := newPreparedData(v)
+	user := p.resolveUser(data, userID)
+	user.nb = a.Users[userID]
+	user.reply = a.UsersReply[userID]
+	data.users = []analyticsData{user}
+	data.edits = a.UsersEdits[userID]
+	data.deletes = a.UsersDeletes[userID]
+	data.channels = []analyticsData{newPrivateChannelsLine()}
+	for key, users := range a.ChannelsUsers {
+		nb := users[userID]
+		if nb == 0 {
+			continue
+		}
+		line := p.resolveChannel(data, key)
+		if line.private {
+			data.totalMessagesPrivate += nb
+		} else {
+			data.totalMessagesPublic += nb
 		}
-		users = p.updateOrAppend(users, analyticsData{id: key, displayName: displayKey, name: displayKey, nb: 0, reply: nb})
+		line.nb = nb
+		line.reply = a.ChannelsUsersReply[key][userID]
+		data.channels = p.updateOrAppend(data.channels, line)
+	}
+	if data.channels[0].nb == 0 {
+		data.channels = data.channels[1:]
+	}
+	sort.Slice(data.channels, func(i, j int) bool {
+		return data.channels[i].nb > data.channels[j].nb
+	})
+	return data, nil
+}
+
+// prepareFilesData build channels lines with number of files and weight uploaded in each channel
+func (p *Plugin) prepareFilesData(a *Analytic, v *viewer) (*preparedData, error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	data := newPreparedData(v)
+	data.channels = append(data.channels, newPrivateChannelsLine())
+	data.filesNb = a.FilesNb
+	data.filesSize = a.FilesSize
+	for key, nb := range a.ChannelsFilesNb {
+		line := p.resolveChannel(data, key)
+		line.nb = nb
+		line.size = a.ChannelsFilesSize[key]
+		data.channels = p.updateOrAppend(data.channels, line)
+	}
+	if data.channels[0].nb == 0 {
+		data.channels = data.channels[1:]
 	}
-	sort.Slice(users, func(i, j int) bool {
-		return users[i].nb > users[j].nb
+	sort.Slice(data.channels, func(i, j int) bool {
+		return data.channels[i].nb > data.channels[j].nb
 	})
-	sort.Slice(channels, func(i, j int) bool {
-		return channels[i].nb > channels[j].nb
+	return data, nil
+}
+
+// prepareUsers build sorted users lines from messages and replies by user id
+// users who opted out are left out, and all users when rankings are hidden
+// caller must hold the read lock of the analytic owning these maps
+func (p *Plugin) prepareUsers(data *preparedData, messages map[string]int64, replies map[string]int64) []analyticsData {
+	users := make([]analyticsData, 0)
+	privacy := p.getUserPrivacy(data)
+	if privacy.hidden {
+		return users
+	}
+	for key, nb := range messages {
+		line := p.resolveUser(data, key)
+		line.nb = nb
+		users = p.updateOrAppend(users, line)
+	}
+	for key, nb := range replies {
+		line := p.resolveUser(data, key)
+		line.reply = nb
+		users = p.updateOrAppend(users, line)
+	}
+	// counters of users can be zero when their deleted posts were subtracted
+	active := make([]analyticsData, 0, len(users))
+	for _, user := range users {
+		if (user.nb > 0 || user.reply > 0) && privacy.ranked(user) {
+			active = append(active, user)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].nb > active[j].nb
 	})
-	return &preparedData{
-		totalMessagesPublic:  totalMessagesPublic,
-		totalMessagesPrivate: totalMessagesPrivate,
-		users:                users,
-		channels:             channels,
-	}, nil
+	return active
 }
 
-func (p *Plugin) updateOrAppend(originals []analyticsData, upsert analyticsData) []analyticsData {
-	var original analyticsData
-	for index, value := range originals {
-		if value.id == upsert.id {
-			original = value
-			originals = append(originals[:index], originals[index+1:]...)
-			break
+// countUsers return the number of users with messages or replies
+// counters of users can be zero when their deleted posts were subtracted
+func countUsers(messages map[string]int64, replies map[string]int64) int {
+	users := make(map[string]bool, len(messages))
+	for key, nb := range messages {
+		if nb > 0 {
+			users[key] = true
 		}
 	}
-	if original.name != "" {
-		if upsert.nb == 0 {
-			upsert.nb = original.nb
+	for key, nb := range replies {
+		if nb > 0 {
+			users[key] = true
 		}
-		if upsert.reply == 0 {
-			upsert.reply = original.reply
+	}
+	return len(users)
+}
+
+// updateOrAppend add counters of upsert to the line with the same id, or append it
+// all unresolved channels or users share the same id, so their counters are summed in one line
+func (p *Plugin) updateOrAppend(originals []analyticsData, upsert analyticsData) []analyticsData {
+	for index, value := range originals {
+		if value.id == upsert.id {
+			originals[index].nb += upsert.nb
+			originals[index].reply += upsert.reply
+			originals[index].size += upsert.size
+			return originals
 		}
 	}
 	return append(originals, upsert)
 }
 
+// resolveChannel return the line of a channel without counters
+// a channel which can't be fetched, like a deleted one, is counted in the unknown channel line instead of failing the report
+// a channel the viewer may not see is counted in the private channels line
+func (p *Plugin) resolveChannel(data *preparedData, key string) analyticsData {
+	channelName, channelDisplayName, link, err := p.getChannelName(key)
+	if err != nil {
+		p.API.LogWarn("can't resolve channel, counted as unknown", "channelID", key, "err", err.Error())
+		data.unresolvedChannels[key] = true
+		return analyticsData{id: unresolvedID, name: unresolvedChannelName, displayName: unresolvedChannelName}
+	}
+	channel, err := p.getChannel(key)
+	if err != nil || !data.viewer.canSee(channel) {
+		return newPrivateChannelsLine()
+	}
+	return analyticsData{id: key, name: channelName, displayName: channelDisplayName, link: link, private: channel.Type != model.CHANNEL_OPEN}
+}
+
+// resolveUser return the line of a user without counters, see resolveChannel
+// the user is anonymized when it opted out or users are named by pseudonyms
+func (p *Plugin) resolveUser(data *preparedData, key string) analyticsData {
+	privacy := p.getUserPrivacy(data)
+	username, err := p.getUsername(key)
+	if err != nil {
+		p.API.LogWarn("can't resolve user, counted as unknown", "userID", key, "err", err.Error())
+		data.unresolvedUsers[key] = true
+		return privacy.anonymize(key, analyticsData{id: unresolvedID, name: unresolvedUserName, displayName: unresolvedUserName})
+	}
+	return privacy.anonymize(key, analyticsData{id: key, name: username, displayName: username})
+}
+
 // getChannelName take a channel id and return name, displayName, link or error
 func (p *Plugin) getChannelName(key string) (string, string, string, error) {
-	channel, err := p.API.GetChannel(key)
+	channel, err := p.getChannel(key)
 	if err != nil {
 		return "", "", "", errors.Wrap(err, "Can't retreive channel name")
 	}
 	if channel.IsGroupOrDirect() {
 		return dmOrPrivateChannelName, dmOrPrivateChannelName, "", nil
 	}
-	team, err := p.API.GetTeam(channel.TeamId)
+	team, err := p.getTeam(channel.TeamId)
 	if err != nil {
-		return "", "", "", &model.AppError{
-			Message:       "Can't retreive team name",
-			DetailedError: err.Error(),
-		}
+		return "", "", "", errors.Wrap(err, "Can't retreive team name")
 	}
 	config := p.API.GetConfig()
-	return channel.Name, team.DisplayName + "/" + channel.DisplayName, *config.ServiceSettings.SiteURL + "/" + team.Name + "/channels/" + channel.Name, nil
+	return channel.Name, team.DisplayName + "/" + channelDisplayName(channel), *config.ServiceSettings.SiteURL + "/" + team.Name + "/channels/" + channel.Name, nil
+}
+
+// getChannelTeamID take a channel id and return its team id (empty for DM) or error
+func (p *Plugin) getChannelTeamID(key string) (string, error) {
+	channel, err := p.getChannel(key)
+	if err != nil {
+		return "", errors.Wrap(err, "Can't retreive channel team")
+	}
+	return channel.TeamId, nil
 }
 
 // getChannelDisplayName take a channel id and return displayName or error
 func (p *Plugin) getChannelDisplayName(key string) (string, error) {
-	channel, err := p.API.GetChannel(key)
+	channel, err := p.getChannel(key)
 	if err != nil {
 		return "", errors.Wrap(err, "Can't retreive channel name")
 	}
 	if channel.IsGroupOrDirect() {
 		return dmOrPrivateChannelName, nil
 	}
-	return channel.DisplayName, nil
+	return channelDisplayName(channel), nil
 }
 
-// getUsername take a user id and return username or error
+// channelDisplayName return the display name of a channel, archived ones are marked as such
+func channelDisplayName(channel *model.Channel) string {
+	if channel.DeleteAt > 0 {
+		return channel.DisplayName + archivedChannelSuffix
+	}
+	return channel.DisplayName
+}
+
+// getUsername take a user id and return username or error, deactivated users are named deleted user
 func (p *Plugin) getUsername(key string) (string, error) {
-	user, err := p.API.GetUser(key)
+	user, err := p.getUser(key)
 	if err != nil {
 		return "", errors.Wrap(err, "Can't retreive user name")
 	}
+	if user.DeleteAt > 0 {
+		return deletedUserName, nil
+	}
 	return user.Username, nil
 }
 
@@ -1,18 +1,59 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/mattermost/mattermost-server/plugin"
 	"github.com/stretchr/testify/assert"
 )
 
+// kvAPI is an api with only a kv store
+type kvAPI struct {
+	plugin.API
+	kv map[string][]byte
+}
+
+func (api *kvAPI) KVGet(key string) ([]byte, *model.AppError) {
+	return api.kv[key], nil
+}
+
+func (api *kvAPI) KVSet(key string, value []byte) *model.AppError {
+	api.kv[key] = value
+	return nil
+}
+
+func (api *kvAPI) KVSetWithExpiry(key string, value []byte, expireInSeconds int64) *model.AppError {
+	return api.KVSet(key, value)
+}
+
+func (api *kvAPI) KVDelete(key string) *model.AppError {
+	delete(api.kv, key)
+	return nil
+}
+
+func (api *kvAPI) LogInfo(msg string, keyValuePairs ...interface{}) {}
+
+func (api *kvAPI) LogWarn(msg string, keyValuePairs ...interface{}) {}
+
 func TestServeHTTP(t *testing.T) {
 	assert := assert.New(t)
+	id := model.NewId()
+	spec, err := json.Marshal(&chartSpec{Kind: pieChart, Labels: []string{"chan1", "chan2"}, Values: []float64{1, 1}})
+	assert.Nil(err)
 	plugin := Plugin{}
+	plugin.API = &kvAPI{kv: map[string][]byte{chartKey(id): spec}}
+
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest("GET", "/pie.svg?chan1=1&chan2=1", nil)
+	plugin.ServeHTTP(nil, w, httptest.NewRequest("GET", "/pie.svg?chan1=1&chan2=1", nil))
+	assert.Equal(http.StatusNotFound, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", chartPrefix+id+".svg", nil)
 
 	plugin.ServeHTTP(nil, w, r)
 
@@ -24,3 +65,25 @@ func TestServeHTTP(t *testing.T) {
 
 	assert.Equal("<svg xmlns=\"http://www.w3.org/2000/svg\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" width=\"300\" height=\"300\">\\n<path  d=\"M 0 0\nL 300 0\nL 300 300\nL 0 300\nL 0 0\" style=\"stroke-width:0;stroke:rgba(255,255,255,1.0);fill:rgba(255,255,255,1.0)\"/><path  d=\"M 5 5\nL 295 5\nL 295 295\nL 5 295\nL 5 5\" style=\"stroke-width:0;stroke:rgba(255,255,255,1.0);fill:rgba(255,255,255,1.0)\"/><path  d=\"M 150 150\nL 295 150\nA 145 145 180.00 0 1 5 150\nL 150 150\nZ\" style=\"stroke-width:5;stroke:rgba(255,255,255,1.0);fill:rgba(106,195,203,1.0)\"/><path  d=\"M 150 150\nL 5 150\nA 145 145 180.00 0 1 295 150\nL 150 150\nZ\" style=\"stroke-width:5;stroke:rgba(255,255,255,1.0);fill:rgba(42,190,137,1.0)\"/><text x=\"129\" y=\"253\" style=\"stroke-width:0;stroke:none;fill:rgba(51,51,51,1.0);font-size:15.3px;font-family:'Roboto Medium',sans-serif\">chan1</text><text x=\"129\" y=\"61\" style=\"stroke-width:0;stroke:none;fill:rgba(51,51,51,1.0);font-size:15.3px;font-family:'Roboto Medium',sans-serif\">chan2</text></svg>", bodyString)
 }
+
+func TestUpdateOrAppend(t *testing.T) {
+	assert := assert.New(t)
+	plugin := Plugin{}
+
+	lines := plugin.updateOrAppend(nil, analyticsData{id: "a", name: "a", nb: 2})
+	lines = plugin.updateOrAppend(lines, analyticsData{id: unresolvedID, name: unresolvedChannelName, nb: 1})
+	lines = plugin.updateOrAppend(lines, analyticsData{id: unresolvedID, name: unresolvedChannelName, nb: 3})
+	lines = plugin.updateOrAppend(lines, analyticsData{id: "a", name: "a", reply: 1})
+
+	assert.Equal([]analyticsData{
+		{id: "a", name: "a", nb: 2, reply: 1},
+		{id: unresolvedID, name: unresolvedChannelName, nb: 4},
+	}, lines)
+	assert.Equal("@a", getUserMention(lines[0]))
+	assert.Equal("*deleted user*", getUserMention(analyticsData{id: "b", name: deletedUserName}))
+
+	data := newPreparedData(nil)
+	assert.Equal("", getUnresolvedWarning(data))
+	data.unresolvedChannels["c"] = true
+	assert.Contains(getUnresolvedWarning(data), "**1 channels** and **0 users**")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// postsPollKey store the round of polls of posts, so a new leader continues from it
+	// it was named when only reactions were polled
+	postsPollKey = "reactionsPoll"
+	// postsPollWindow is how long after its last message a channel is polled for updated posts
+	postsPollWindow = 7 * 24 * time.Hour
+	// postsPollChannelsRefresh is how often channels to poll are read again from stored buckets
+	postsPollChannelsRefresh = time.Hour
+	// postsPollInterval is the minimal time between two rounds of polls
+	postsPollInterval = 5 * time.Minute
+	// postsPollChannelsPerTick is the number of channels polled each minute, a round lasts as many minutes as needed
+	postsPollChannelsPerTick = 50
+)
+
+// postsPollRound is a poll of posts updated between Since and Until in Channels, Done channels are already polled
+// times are in milliseconds like post times
+type postsPollRound struct {
+	Since    int64
+	Until    int64
+	Channels []string
+	Done     int
+}
+
+func (r *postsPollRound) finished() bool {
+	return r.Done >= len(r.Channels)
+}
+
+// postsPoller keep channels polled for updated posts, they are read from buckets once an hour
+type postsPoller struct {
+	channels    map[string]bool
+	refreshedAt time.Time
+}
+
+// pollPosts count reactions and deletions since the last round of polls, only the leader must run it
+// mattermost has no hook for them, but adding a reaction or deleting a post updates the post
+// so it's returned by GetPostsSince. Removed reactions are not subtracted
+// a round starts every postsPollInterval at most and polls postsPollChannelsPerTick channels by call
+func (p *Plugin) pollPosts() {
+	config := p.getConfiguration()
+	if !config.TrackReactions && !config.TrackDeletions {
+		return
+	}
+	p.pollLock.Lock()
+	defer p.pollLock.Unlock()
+
+	now := time.Now()
+	round, err := p.loadPostsPoll()
+	if err != nil {
+		p.API.LogError("can't load last poll of posts", "err", err.Error())
+		return
+	}
+	if round == nil {
+		// first poll, reactions and deletions before are not counted
+		if err := p.savePostsPoll(&postsPollRound{Since: toMillis(now), Until: toMillis(now)}); err != nil {
+			p.API.LogError("can't save poll of posts", "err", err.Error())
+		}
+		return
+	}
+	if round.finished() {
+		if now.Sub(fromMillis(round.Until)) < postsPollInterval {
+			return
+		}
+		round = newPostsPollRound(round.Until, toMillis(now), p.pollChannels(now))
+	}
+
+	end := round.Done + postsPollChannelsPerTick
+	if end > len(round.Channels) {
+		end = len(round.Channels)
+	}
+	for ; round.Done < end; round.Done++ {
+		channelID := round.Channels[round.Done]
+		if err := p.pollChannelPosts(channelID, round.Since, round.Until); err != nil {
+			p.API.LogWarn("can't poll posts", "channelID", channelID, "err", err.Error())
+		}
+	}
+	if err := p.savePostsPoll(round); err != nil {
+		p.API.LogError("can't save poll of posts", "err", err.Error())
+	}
+}
+
+// newPostsPollRound return a round polling channels, sorted so the order is stable
+func newPostsPollRound(since int64, until int64, channels map[string]bool) *postsPollRound {
+	round := &postsPollRound{Since: since, Until: until, Channels: make([]string, 0, len(channels))}
+	for channelID := range channels {
+		round.Channels = append(round.Channels, channelID)
+	}
+	sort.Strings(round.Channels)
+	return round
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// pollChannels return channels with messages during postsPollWindow, caller must hold pollLock
+func (p *Plugin) pollChannels(now time.Time) map[string]bool {
+	if p.poller == nil || now.Sub(p.poller.refreshedAt) > postsPollChannelsRefresh {
+		a := p.analyticBetween(period{since: bucketStart(now.Add(-postsPollWindow))})
+		channels := make(map[string]bool)
+		for channelID := range a.Channels {
+			channels[channelID] = true
+		}
+		p.poller = &postsPoller{channels: channels, refreshedAt: now}
+	}
+
+	channels := make(map[string]bool, len(p.poller.channels))
+	for channelID := range p.poller.channels {
+		channels[channelID] = true
+	}
+	p.currentAnalytic.RLock()
+	for channelID := range p.currentAnalytic.Channels {
+		channels[channelID] = true
+	}
+	p.currentAnalytic.RUnlock()
+	return channels
+}
+
+// pollChannelPosts count reactions and deletions between since and until on posts of a channel
+// posts of sources which aren't counted are ignored, their reactions and deletions too
+func (p *Plugin) pollChannelPosts(channelID string, since int64, until int64) error {
+	config := p.getConfiguration()
+	posts, appErr := p.API.GetPostsSince(channelID, since)
+	if appErr != nil {
+		return errors.Wrap(appErr, "can't get updated posts")
+	}
+	for _, post := range posts.Posts {
+		if !config.isCounted(p.getPostSource(post)) {
+			continue
+		}
+		if post.DeleteAt > 0 {
+			if config.TrackDeletions && post.DeleteAt > since && post.DeleteAt <= until {
+				p.countDeletion(post)
+			}
+			continue
+		}
+		if config.TrackReactions && post.HasReactions {
+			if err := p.pollPostReactions(post, since, until); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadPostsPoll return the current round of polls, nil before the first poll
+// the time of the last poll stored by previous versions is read as a finished round
+func (p *Plugin) loadPostsPoll() (*postsPollRound, error) {
+	j, appErr := p.API.KVGet(postsPollKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get poll of posts")
+	}
+	if len(j) == 0 {
+		return nil, nil
+	}
+	if millis, err := strconv.ParseInt(string(j), 10, 64); err == nil {
+		return &postsPollRound{Since: millis, Until: millis}, nil
+	}
+	round := &postsPollRound{}
+	if err := json.Unmarshal(j, round); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal poll of posts")
+	}
+	return round, nil
+}
+
+func (p *Plugin) savePostsPoll(round *postsPollRound) error {
+	j, err := json.Marshal(round)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal poll of posts")
+	}
+	if appErr := p.API.KVSet(postsPollKey, j); appErr != nil {
+		return errors.Wrap(appErr, "can't save poll of posts")
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostsPollRound(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(now, fromMillis(toMillis(now)).UTC())
+
+	round := newPostsPollRound(1000, 2000, map[string]bool{"chan2": true, "chan1": true})
+	assert.Equal([]string{"chan1", "chan2"}, round.Channels)
+	assert.False(round.finished())
+	round.Done = 2
+	assert.True(round.finished())
+	assert.True((&postsPollRound{Since: 1000, Until: 1000}).finished())
+}
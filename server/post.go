@@ -2,7 +2,8 @@ package main
 
 import (
 	"fmt"
-	"net/url"
+	"sort"
+	"time"
 
 	"github.com/mattermost/mattermost-server/model"
 	"github.com/pkg/errors"
@@ -11,90 +12,337 @@ import (
 const (
 	maxChannelsToDisplay = 10
 	maxUsersToDisplay    = 10
+	maxEmojisToDisplay   = 10
+	// defaultReportDuration is the period of a report when no since is given
+	defaultReportDuration = 7 * 24 * time.Hour
+	// defaultTrendsDuration is the minimal period drawn in trends charts
+	defaultTrendsDuration = 12 * 7 * 24 * time.Hour
 )
 
-func (p *Plugin) buildAnalyticAttachments() ([]*model.SlackAttachment, error) {
+// buildAnalyticAttachments and other build functions return reports for a viewer, see viewer
+func (p *Plugin) buildAnalyticAttachments(pe period, v *viewer) ([]*model.SlackAttachment, error) {
+	pe = pe.withDefaultSince(defaultReportDuration)
+	location := p.getConfiguration().getReportLocation()
+	h := p.loadHistory(reportSince(pe, location))
+	return p.buildReportAttachments("Analytics", h.between(pe), trends(h, pe), getActiveUsers(h, pe, nil, location), v)
+}
+
+func (p *Plugin) buildTeamAnalyticAttachments(pe period, teamID string, v *viewer) ([]*model.SlackAttachment, error) {
+	team, err := p.getTeam(teamID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't retreive team")
+	}
+
+	pe = pe.withDefaultSince(defaultReportDuration)
+	location := p.getConfiguration().getReportLocation()
+	h := p.loadHistory(reportSince(pe, location))
+	a := h.between(pe)
+	inTeam := p.teamFilter(a, teamID)
+	filtered := a.FilterChannels(inTeam)
+	steps := make([]*Analytic, 0)
+	for _, step := range trends(h, pe) {
+		steps = append(steps, step.FilterChannels(inTeam))
+	}
+	return p.buildReportAttachments(fmt.Sprintf("Analytics of team %s", team.DisplayName), filtered, steps, getActiveUsers(h, pe, inTeam, location), v)
+}
+
+func (p *Plugin) buildReportAttachments(title string, a *Analytic, steps []*Analytic, active *activeUsers, v *viewer) ([]*model.SlackAttachment, error) {
 	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
 
-	data, err := p.prepareData()
+	data, err := p.prepareData(a, v)
 	if err != nil {
 		return nil, err
 	}
 
-	p.currentAnalytic.RLock()
-	text := fmt.Sprintf("## Analytics since %s, at %s.\n", p.currentAnalytic.Start.Format("January 2, 2006"), p.currentAnalytic.Start.Format("15:04"))
-	p.currentAnalytic.RUnlock()
+	a.RLock()
+	text := fmt.Sprintf("## %s %s.\n", title, formatPeriod(a))
+	a.RUnlock()
 	if data.totalMessagesPublic+data.totalMessagesPrivate > 0 {
-		text += fmt.Sprintf("#### **%d users** sent **%d messages** in **%d channels**. **%d** *(%d%%)* of the messages were in public channels, **%d** *(%d%%)* in private.\n", len(data.users), data.totalMessagesPublic+data.totalMessagesPrivate, len(data.channels), data.totalMessagesPublic, (data.totalMessagesPublic*100)/(data.totalMessagesPublic+data.totalMessagesPrivate), data.totalMessagesPrivate, (data.totalMessagesPrivate*100)/(data.totalMessagesPublic+data.totalMessagesPrivate))
-		text += fmt.Sprintf("#### Moreover, **%d files** were sent for a total uppload size of **%s**.\n", p.currentAnalytic.FilesNb, byteCountDecimal(p.currentAnalytic.FilesSize))
+		text += fmt.Sprintf("#### **%d users** sent **%d messages** in **%d channels**. **%d** *(%d%%)* of the messages were in public channels, **%d** *(%d%%)* in private.\n", data.totalUsers, data.totalMessagesPublic+data.totalMessagesPrivate, len(data.channels), data.totalMessagesPublic, (data.totalMessagesPublic*100)/(data.totalMessagesPublic+data.totalMessagesPrivate), data.totalMessagesPrivate, (data.totalMessagesPrivate*100)/(data.totalMessagesPublic+data.totalMessagesPrivate))
+		text += fmt.Sprintf("#### Moreover, **%d files** were sent for a total uppload size of **%s**.\n", data.filesNb, byteCountDecimal(data.filesSize))
+	}
+	text += p.getEditsText(data, data.totalMessagesPublic+data.totalMessagesPrivate)
+	text += getUnresolvedWarning(data)
+
+	fields, err := p.getUsersFields(*siteURL, data, getPercentComparingToPublicMessages)
+	if err != nil {
+		return nil, err
+	}
+	channelsFields, err := p.getChannelsFields(*siteURL, data)
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, channelsFields...)
+	reactionsFields, err := p.getReactionsFields(*siteURL, data)
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, reactionsFields...)
+	fields = append(fields, getThreadsFields(data)...)
+	integrationsFields, err := p.getIntegrationsFields(*siteURL, data)
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, integrationsFields...)
+	a.RLock()
+	heatmapFields, err := p.getHeatmapFields(*siteURL, a.Heatmap)
+	a.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, heatmapFields...)
+	activeFields, err := p.getActiveUsersFields(*siteURL, active)
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, activeFields...)
+	trendsFields, err := p.getTrendsFields(*siteURL, steps, v)
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, trendsFields...)
+
+	return buildAttachments(text, fields), nil
+}
+
+func (p *Plugin) buildChannelAnalyticAttachments(pe period, channelID string, v *viewer) ([]*model.SlackAttachment, error) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+
+	pe = pe.withDefaultSince(defaultReportDuration)
+	h := p.loadHistory(trendsPeriod(pe).since)
+	a := h.between(pe)
+	data, err := p.prepareChannelData(a, channelID, v)
+	if err != nil {
+		return nil, err
 	}
+	channel := data.channels[0]
 
-	fields := append(getUsersFields(*siteURL, data), getChannelsFields(*siteURL, data)...)
-	sessions, err := p.getSessionsFields(*siteURL)
+	a.RLock()
+	text := fmt.Sprintf("## Analytics of %s %s.\n", getChannelLink(channel), formatPeriod(a))
+	a.RUnlock()
+	if channel.nb > 0 {
+		text += fmt.Sprintf("#### **%d users** sent **%d messages** in this channel. **%d** *(%d%%)* of the messages were replies.\n", data.totalUsers, channel.nb, channel.reply, (channel.reply*100)/channel.nb)
+		text += fmt.Sprintf("#### Moreover, **%d files** were sent for a total uppload size of **%s**.\n", data.filesNb, byteCountDecimal(data.filesSize))
+	} else {
+		text += "#### No message was sent in this channel.\n"
+	}
+	text += p.getEditsText(data, channel.nb)
+	text += getUnresolvedWarning(data)
+
+	fields, err := p.getUsersFields(*siteURL, data, getPercentComparingToAllMessages)
 	if err != nil {
 		return nil, err
 	}
-	fields = append(fields, sessions...)
+	fields = append(fields, getThreadsFields(data)...)
+	trendsFields, err := p.getChannelTrendsFields(*siteURL, channel, trends(h, pe))
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, trendsFields...)
+
+	return buildAttachments(text, fields), nil
+}
+
+func (p *Plugin) buildUserAnalyticAttachments(pe period, userID string, v *viewer) ([]*model.SlackAttachment, error) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+
+	pe = pe.withDefaultSince(defaultReportDuration)
+	a := p.analyticBetween(pe)
+	data, err := p.prepareUserData(a, userID, v)
+	if err != nil {
+		return nil, err
+	}
+	user := data.users[0]
+	// the report of a pseudonym would tell who it is
+	if user.anonymous || p.getUserPrivacy(data).hidden {
+		return nil, newCommandError("Analytics of this user are not available")
+	}
+
+	a.RLock()
+	text := fmt.Sprintf("## Analytics of %s %s.\n", getUserMention(user), formatPeriod(a))
+	a.RUnlock()
+	if user.nb > 0 {
+		text += fmt.Sprintf("#### %s sent **%d messages** in **%d channels**. **%d** *(%d%%)* of the messages were replies.\n", getUserMention(user), user.nb, len(data.channels), user.reply, (user.reply*100)/user.nb)
+	} else {
+		text += fmt.Sprintf("#### %s didn't send any message.\n", getUserMention(user))
+	}
+	text += p.getEditsText(data, user.nb)
+	text += getUnresolvedWarning(data)
+
+	fields, err := p.getChannelsFields(*siteURL, data)
+	if err != nil {
+		return nil, err
+	}
+	return buildAttachments(text, fields), nil
+}
+
+func (p *Plugin) buildFilesAnalyticAttachments(pe period, v *viewer) ([]*model.SlackAttachment, error) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+
+	pe = pe.withDefaultSince(defaultReportDuration)
+	a := p.analyticBetween(pe)
+	data, err := p.prepareFilesData(a, v)
+	if err != nil {
+		return nil, err
+	}
+
+	a.RLock()
+	text := fmt.Sprintf("## Files analytics %s.\n", formatPeriod(a))
+	a.RUnlock()
+	text += fmt.Sprintf("#### **%d files** were sent for a total uppload size of **%s**.\n", data.filesNb, byteCountDecimal(data.filesSize))
+	text += getUnresolvedWarning(data)
+
+	fields, err := p.getFilesFields(*siteURL, data)
+	if err != nil {
+		return nil, err
+	}
+	return buildAttachments(text, fields), nil
+}
+
+func (p *Plugin) buildTrendsAnalyticAttachments(pe period, v *viewer) ([]*model.SlackAttachment, error) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+
+	pe = pe.withDefaultSince(defaultTrendsDuration)
+	steps := p.analyticsByStep(pe, trendsStep(pe))
+	text := fmt.Sprintf("## Trends of all channels %s.\n", formatPeriod(&Analytic{Start: pe.since, End: pe.until}))
+	if len(steps) < 2 {
+		text += "#### Not enough data to draw trends.\n"
+		return buildAttachments(text, nil), nil
+	}
+	text += fmt.Sprintf("#### Messages by channel for each of the **%d** %s.\n", len(steps), stepName(steps[0]))
+
+	fields, err := p.getTrendsFields(*siteURL, steps, v)
+	if err != nil {
+		return nil, err
+	}
+	return buildAttachments(text, fields), nil
+}
+
+// sendAnalytics post the report of a schedule in each of its channels, see buildScheduledAttachments
+func (p *Plugin) sendAnalytics(pe period, schedule *reportSchedule) error {
+	for _, channelID := range schedule.channelsID {
+		attachments, err := p.buildScheduledAttachments(pe, schedule, channelID)
+		if err != nil {
+			return errors.Wrap(err, "can't build analytics attachments")
+		}
+		if err := p.postAttachments(channelID, attachments); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildScheduledAttachments return the report of a destination, built for the members of its channel
+// team destinations receive the report of their team, others the report of the whole instance
+func (p *Plugin) buildScheduledAttachments(pe period, schedule *reportSchedule, channelID string) ([]*model.SlackAttachment, error) {
+	v := newChannelViewer(channelID)
+	if teamID, ok := schedule.teams[channelID]; ok {
+		return p.buildTeamAnalyticAttachments(pe, teamID, v)
+	}
+	return p.buildAnalyticAttachments(pe, v)
+}
+
+func (p *Plugin) postAttachments(channelID string, attachments []*model.SlackAttachment) error {
+	post := &model.Post{
+		UserId:    p.BotUserID,
+		ChannelId: channelID,
+		Props: map[string]interface{}{
+			"from_webhook":      "true",
+			"from_plugin":       "true",
+			"override_username": p.getConfiguration().BotUsername,
+			"override_icon_url": p.getConfiguration().BotIconURL,
+			"attachments":       attachments,
+		},
+	}
 
+	if _, err := p.API.CreatePost(post); err != nil {
+		return errors.Wrap(err, "can't post mesage")
+	}
+	return nil
+}
+
+func buildAttachments(text string, fields []*model.SlackAttachmentField) []*model.SlackAttachment {
 	attachments := make([]*model.SlackAttachment, 1)
 	attachments[0] = &model.SlackAttachment{
 		Color:  "#FF8000",
 		Text:   text,
 		Fields: fields,
 	}
+	return attachments
+}
 
-	return attachments, nil
+// trends return analytics of each step drawn in trends charts of a report
+func trends(h *history, pe period) []*Analytic {
+	pe = trendsPeriod(pe)
+	return h.byStep(pe, trendsStep(pe))
 }
 
-func (p *Plugin) sendAnalytics(ChannelsID []string) error {
-	attachments, err := p.buildAnalyticAttachments()
-	if err != nil {
-		return errors.Wrap(err, "can't build analytics attachments")
+// reportSince return the start of the history read by a report, its trends and active users included
+func reportSince(pe period, location *time.Location) time.Time {
+	since := trendsPeriod(pe).since
+	if active := activeUsersSince(pe, location); active.Before(since) {
+		since = active
 	}
-	for _, channelID := range ChannelsID {
-		post := &model.Post{
-			UserId:    p.BotUserID,
-			ChannelId: channelID,
-			Props: map[string]interface{}{
-				"from_webhook":      "true",
-				"override_username": p.getConfiguration().BotUsername,
-				"override_icon_url": p.getConfiguration().BotIconURL,
-				"attachments":       attachments,
-			},
-		}
+	return since
+}
 
-		if _, err := p.API.CreatePost(post); err != nil {
-			return errors.Wrap(err, "can't post mesage")
-		}
+// trendsPeriod return the period drawn in trends charts of a report
+// it covers at least defaultTrendsDuration before the end of the report
+func trendsPeriod(pe period) period {
+	trends := period{until: pe.until}.withDefaultSince(defaultTrendsDuration)
+	if !pe.since.IsZero() && pe.since.Before(trends.since) {
+		trends.since = pe.since
 	}
+	return trends
+}
 
-	return nil
+// trendsStep return the duration of each point of a trends chart, a week unless the period is too short
+func trendsStep(pe period) time.Duration {
+	if pe.end().Sub(pe.since) <= 14*24*time.Hour {
+		return 24 * time.Hour
+	}
+	return 7 * 24 * time.Hour
+}
+
+func stepName(step *Analytic) string {
+	if step.End.Sub(step.Start) < 7*24*time.Hour {
+		return "days"
+	}
+	return "weeks"
+}
+
+// formatPeriod return a humanized representation of the period covered by an analytic
+func formatPeriod(a *Analytic) string {
+	if a.End.IsZero() {
+		return fmt.Sprintf("since %s, at %s", a.Start.Format("January 2, 2006"), a.Start.Format("15:04"))
+	}
+	return fmt.Sprintf("from %s to %s", a.Start.Format("January 2, 2006"), a.End.Add(-time.Second).Format("January 2, 2006"))
 }
 
-func getUsersFields(siteURL string, data *preparedData) []*model.SlackAttachmentField {
+// getUsersFields display top users, nothing when user rankings are hidden
+func (p *Plugin) getUsersFields(siteURL string, data *preparedData, percent func(*preparedData, analyticsData) int64) ([]*model.SlackAttachmentField, error) {
+	if p.getUserPrivacy(data).hidden {
+		return nil, nil
+	}
 	m := "### Top Users\n"
 	if len(data.users) > 0 {
-		m = m + fmt.Sprintf("* :1st_place_medal: @%s: **%d** messages *(%d%% of total)* with %d replies.\n", data.users[0].name, data.users[0].nb, getPercentComparingToPublicMessages(data, data.users[0]), data.users[0].reply)
+		m = m + fmt.Sprintf("* :1st_place_medal: %s: **%d** messages *(%d%% of total)* with %d replies.\n", getUserMention(data.users[0]), data.users[0].nb, percent(data, data.users[0]), data.users[0].reply)
 	}
 	if len(data.users) > 1 {
-		m = m + fmt.Sprintf("* :2nd_place_medal: @%s: **%d** messages *(%d%% of total)* with %d replies.\n", data.users[1].name, data.users[1].nb, getPercentComparingToPublicMessages(data, data.users[1]), data.users[1].reply)
+		m = m + fmt.Sprintf("* :2nd_place_medal: %s: **%d** messages *(%d%% of total)* with %d replies.\n", getUserMention(data.users[1]), data.users[1].nb, percent(data, data.users[1]), data.users[1].reply)
 	}
 	if len(data.users) > 2 {
-		m = m + fmt.Sprintf("* :3rd_place_medal: @%s: **%d** messages *(%d%% of total)* with %d replies.\n", data.users[2].name, data.users[2].nb, getPercentComparingToPublicMessages(data, data.users[2]), data.users[2].reply)
+		m = m + fmt.Sprintf("* :3rd_place_medal: %s: **%d** messages *(%d%% of total)* with %d replies.\n", getUserMention(data.users[2]), data.users[2].nb, percent(data, data.users[2]), data.users[2].reply)
 	}
-	urlChart, _ := url.Parse(siteURL + "/plugins/com.github.manland.mattermost-plugin-analytics/pie.svg")
-	parametersURL := url.Values{}
-	for index, c := range data.users {
-		if index > maxUsersToDisplay {
-			break
-		}
-		parametersURL.Add(c.displayName, fmt.Sprintf("%d", c.nb))
+	urlChart, err := p.saveChart(siteURL, topChartSpec(pieChart, data.users, maxUsersToDisplay))
+	if err != nil {
+		return nil, err
 	}
-	urlChart.RawQuery = parametersURL.Encode()
-	return buildSlackAttachmentField(m, "users pie chart", urlChart)
+	return buildSlackAttachmentField(m, "users pie chart", urlChart), nil
 }
 
-func getChannelsFields(siteURL string, data *preparedData) []*model.SlackAttachmentField {
+func (p *Plugin) getChannelsFields(siteURL string, data *preparedData) ([]*model.SlackAttachmentField, error) {
 	m := "### Top Channels\n"
 	if len(data.channels) > 0 {
 		m = m + fmt.Sprintf("* :1st_place_medal: %s: **%d** messages *(%d%% of total)* with %d replies.\n", getChannelLink(data.channels[0]), data.channels[0].nb, getPercentComparingToAllMessages(data, data.channels[0]), data.channels[0].reply)
@@ -105,53 +353,136 @@ func getChannelsFields(siteURL string, data *preparedData) []*model.SlackAttachm
 	if len(data.channels) > 2 {
 		m = m + fmt.Sprintf("* :3rd_place_medal: %s: **%d** messages *(%d%% of total)* with %d replies.\n", getChannelLink(data.channels[2]), data.channels[2].nb, getPercentComparingToAllMessages(data, data.channels[2]), data.channels[2].reply)
 	}
-	urlChart, _ := url.Parse(siteURL + "/plugins/com.github.manland.mattermost-plugin-analytics/pie.svg")
-	parametersURL := url.Values{}
-	for index, c := range data.channels {
-		if index > maxChannelsToDisplay {
+	urlChart, err := p.saveChart(siteURL, topChartSpec(pieChart, data.channels, maxChannelsToDisplay))
+	if err != nil {
+		return nil, err
+	}
+	return buildSlackAttachmentField(m, "channels pie chart", urlChart), nil
+}
+
+// getReactionsFields list users who received the most reactions and draw most used emojis
+// nothing is displayed when no reaction was counted
+func (p *Plugin) getReactionsFields(siteURL string, data *preparedData) ([]*model.SlackAttachmentField, error) {
+	if len(data.emojis) == 0 {
+		return nil, nil
+	}
+	m := "### Most appreciated\n"
+	medals := []string{":1st_place_medal:", ":2nd_place_medal:", ":3rd_place_medal:"}
+	for index, user := range data.appreciated {
+		if index >= len(medals) || user.nb == 0 {
+			break
+		}
+		m = m + fmt.Sprintf("* %s %s: **%d** reactions received, %d given.\n", medals[index], getUserMention(user), user.nb, user.reply)
+	}
+	m = m + "#### Top emojis\n"
+	for index, emoji := range data.emojis {
+		if index >= len(medals) {
 			break
 		}
-		parametersURL.Add(c.displayName, fmt.Sprintf("%d", c.nb))
+		m = m + fmt.Sprintf("* :%s: used **%d** times.\n", emoji.name, emoji.nb)
 	}
-	urlChart.RawQuery = parametersURL.Encode()
-	return buildSlackAttachmentField(m, "channels pie chart", urlChart)
+	urlChart, err := p.saveChart(siteURL, topChartSpec(barChart, data.emojis, maxEmojisToDisplay))
+	if err != nil {
+		return nil, err
+	}
+	return buildSlackAttachmentField(m, "emojis bar chart", urlChart), nil
 }
 
-func (p *Plugin) getSessionsFields(siteURL string) ([]*model.SlackAttachmentField, error) {
-	allSessions, _ := p.allSessions()
-	urlChart, _ := url.Parse(siteURL + "/plugins/com.github.manland.mattermost-plugin-analytics/line.svg")
-	parametersURL := url.Values{}
+func (p *Plugin) getFilesFields(siteURL string, data *preparedData) ([]*model.SlackAttachmentField, error) {
+	m := "### Top Channels\n"
+	if len(data.channels) > 0 {
+		m = m + fmt.Sprintf("* :1st_place_medal: %s: **%d** files *(%s)*.\n", getChannelLink(data.channels[0]), data.channels[0].nb, byteCountDecimal(data.channels[0].size))
+	}
+	if len(data.channels) > 1 {
+		m = m + fmt.Sprintf("* :2nd_place_medal: %s: **%d** files *(%s)*.\n", getChannelLink(data.channels[1]), data.channels[1].nb, byteCountDecimal(data.channels[1].size))
+	}
+	if len(data.channels) > 2 {
+		m = m + fmt.Sprintf("* :3rd_place_medal: %s: **%d** files *(%s)*.\n", getChannelLink(data.channels[2]), data.channels[2].nb, byteCountDecimal(data.channels[2].size))
+	}
+	urlChart, err := p.saveChart(siteURL, topChartSpec(barChart, data.channels, maxChannelsToDisplay))
+	if err != nil {
+		return nil, err
+	}
+	return buildSlackAttachmentField(m, "files bar chart", urlChart), nil
+}
+
+// topChartSpec build a pie or bar chart of the first lines
+func topChartSpec(kind string, lines []analyticsData, max int) *chartSpec {
+	spec := &chartSpec{Kind: kind}
+	for index, c := range lines {
+		if index > max {
+			break
+		}
+		spec.Labels = append(spec.Labels, c.displayName)
+		spec.Values = append(spec.Values, float64(c.nb))
+	}
+	return spec
+}
+
+// getTrendsFields draw messages by channel for each step
+// channels which can't be fetched and channels the viewer may not see are summed in their own lines
+func (p *Plugin) getTrendsFields(siteURL string, steps []*Analytic, v *viewer) ([]*model.SlackAttachmentField, error) {
+	spec := &chartSpec{Kind: lineChart}
 	allChannels := make(map[string]bool, 0)
-	for _, session := range allSessions {
-		for key := range session.Channels {
+	for _, step := range steps {
+		for key := range step.Channels {
 			allChannels[key] = true
 		}
+		spec.Dates = append(spec.Dates, step.Start.Unix())
 	}
-	for _, session := range allSessions {
-		for key := range allChannels {
-			allChannels[key] = false //init with not found
-		}
-		for key, value := range session.Channels {
-			displayKey, err := p.getChannelDisplayName(key)
-			if err != nil {
-				return nil, err
+	keys := make([]string, 0, len(allChannels))
+	for key := range allChannels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := newPreparedData(v)
+	series := make(map[string]*chartSeries)
+	ids := make([]string, 0)
+	for _, key := range keys {
+		line := p.resolveChannel(data, key)
+		s, ok := series[line.id]
+		if !ok {
+			name := line.displayName
+			if line.id == key {
+				// series are named without the team, the channel is already cached by resolveChannel
+				if displayName, err := p.getChannelDisplayName(key); err == nil {
+					name = displayName
+				}
 			}
-			allChannels[key] = true
-			parametersURL.Add(displayKey, fmt.Sprintf("%d", value))
+			s = &chartSeries{Name: name, Values: make([]float64, len(steps))}
+			series[line.id] = s
+			ids = append(ids, line.id)
 		}
-		for key := range allChannels {
-			displayKey, err := p.getChannelDisplayName(key)
-			if err != nil {
-				return nil, err
-			}
-			if !allChannels[key] {
-				parametersURL.Add(displayKey, "0")
-			}
+		for index, step := range steps {
+			s.Values[index] += float64(step.Channels[key])
 		}
-		parametersURL.Add("date", fmt.Sprintf("%d", session.Start.Unix()))
 	}
-	urlChart.RawQuery = parametersURL.Encode()
-	return buildSlackAttachmentField("", "all sessions line chart", urlChart), nil
+	for _, id := range ids {
+		spec.Series = append(spec.Series, *series[id])
+	}
+
+	urlChart, err := p.saveChart(siteURL, spec)
+	if err != nil {
+		return nil, err
+	}
+	return buildSlackAttachmentField("", "trends line chart", urlChart), nil
+}
+
+// getChannelTrendsFields draw the trend of one channel
+func (p *Plugin) getChannelTrendsFields(siteURL string, channel analyticsData, steps []*Analytic) ([]*model.SlackAttachmentField, error) {
+	spec := &chartSpec{Kind: lineChart}
+	series := chartSeries{Name: channel.displayName}
+	for _, step := range steps {
+		series.Values = append(series.Values, float64(step.Channels[channel.id]))
+		spec.Dates = append(spec.Dates, step.Start.Unix())
+	}
+	spec.Series = []chartSeries{series}
+
+	urlChart, err := p.saveChart(siteURL, spec)
+	if err != nil {
+		return nil, err
+	}
+	return buildSlackAttachmentField("", "channel trends line chart", urlChart), nil
 }
 
 func getChannelLink(data analyticsData) string {
@@ -161,15 +492,51 @@ func getChannelLink(data analyticsData) string {
 	return data.displayName
 }
 
+// getUserMention return @username, or the name of a deleted, unknown or anonymous user which can't be mentioned
+func getUserMention(data analyticsData) string {
+	if data.id == unresolvedID || data.name == deletedUserName || data.anonymous {
+		return fmt.Sprintf("*%s*", data.name)
+	}
+	return "@" + data.name
+}
+
+// getEditsText tell how many of the messages were edited and deleted, empty when none was
+// messages are the ones still counted, deleted ones are added back when they were subtracted
+func (p *Plugin) getEditsText(data *preparedData, messages int64) string {
+	if data.edits == 0 && data.deletes == 0 {
+		return ""
+	}
+	if p.getConfiguration().SubtractDeletedPosts {
+		messages += data.deletes
+	}
+	return fmt.Sprintf("#### **%d messages** were edited *(%d%%)* and **%d** deleted *(%d%%)*.\n", data.edits, percentOf(data.edits, messages), data.deletes, percentOf(data.deletes, messages))
+}
+
+// getUnresolvedWarning tell how many channels and users couldn't be fetched, empty when all were found
+func getUnresolvedWarning(data *preparedData) string {
+	if len(data.unresolvedChannels) == 0 && len(data.unresolvedUsers) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("#### :warning: **%d channels** and **%d users** couldn't be found, their messages are counted as %s and %s.\n", len(data.unresolvedChannels), len(data.unresolvedUsers), unresolvedChannelName, unresolvedUserName)
+}
+
 func getPercentComparingToPublicMessages(prepared *preparedData, data analyticsData) int64 {
-	return (data.nb * 100) / prepared.totalMessagesPublic
+	return percentOf(data.nb, prepared.totalMessagesPublic)
 }
 
 func getPercentComparingToAllMessages(prepared *preparedData, data analyticsData) int64 {
-	return (data.nb * 100) / (prepared.totalMessagesPublic + prepared.totalMessagesPrivate)
+	return percentOf(data.nb, prepared.totalMessagesPublic+prepared.totalMessagesPrivate)
+}
+
+// percentOf return nb in percent of total, 0 when total is not positive like when deleted posts were subtracted
+func percentOf(nb int64, total int64) int64 {
+	if total <= 0 {
+		return 0
+	}
+	return (nb * 100) / total
 }
 
-func buildSlackAttachmentField(description string, chartTitle string, chartURL *url.URL) []*model.SlackAttachmentField {
+func buildSlackAttachmentField(description string, chartTitle string, chartURL string) []*model.SlackAttachmentField {
 	attachments := make([]*model.SlackAttachmentField, 0)
 	if description != "" {
 		attachments = append(attachments, &model.SlackAttachmentField{Short: true, Value: description})
@@ -177,7 +544,7 @@ func buildSlackAttachmentField(description string, chartTitle string, chartURL *
 	return append(attachments, &model.SlackAttachmentField{
 		Short: true,
 		// make a md array to have little border around image, working with all themes
-		Value: fmt.Sprintf("| |\n|:-:|\n|![%s](%s)|", chartTitle, chartURL.String()),
+		Value: fmt.Sprintf("| |\n|:-:|\n|![%s](%s)|", chartTitle, chartURL),
 	},
 	)
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	// privateChannelsID is the id of the line of channels the viewer of a report may not see
+	privateChannelsID = "none"
+)
+
+// viewer is the audience of a report, the members of the channel where it is posted
+// they may see public channels and the channel of the report, other channels are only counted in
+// the anonymous private channels line so that reports don't tell which private channels exist
+type viewer struct {
+	channelID      string
+	memberChannels map[string]bool
+}
+
+// newChannelViewer return the viewer of a report posted in a channel
+func newChannelViewer(channelID string) *viewer {
+	return &viewer{channelID: channelID}
+}
+
+// newMemberViewer return the viewer of a report sent to a user, who may see channels it is member of
+func newMemberViewer(memberChannels map[string]bool) *viewer {
+	return &viewer{memberChannels: memberChannels}
+}
+
+// canSee return true when the channel can be named in a report for this viewer
+// a nil viewer, used by the api which already filters channels of its user, sees all channels
+// direct and group messages are never named, they can't be linked and their names are usernames
+func (v *viewer) canSee(channel *model.Channel) bool {
+	if channel.IsGroupOrDirect() {
+		return false
+	}
+	if v == nil {
+		return true
+	}
+	return channel.Type == model.CHANNEL_OPEN || channel.Id == v.channelID || v.memberChannels[channel.Id]
+}
+
+// newPrivateChannelsLine return the anonymous line of channels the viewer may not see
+func newPrivateChannelsLine() analyticsData {
+	return analyticsData{id: privateChannelsID, name: dmOrPrivateChannelName, displayName: dmOrPrivateChannelName, private: true}
+}
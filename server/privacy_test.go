@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViewerCanSee(t *testing.T) {
+	assert := assert.New(t)
+
+	open := &model.Channel{Id: "open", Type: model.CHANNEL_OPEN}
+	private := &model.Channel{Id: "private", Type: model.CHANNEL_PRIVATE}
+	direct := &model.Channel{Id: "direct", Type: model.CHANNEL_DIRECT}
+
+	var all *viewer
+	assert.True(all.canSee(open))
+	assert.True(all.canSee(private))
+	assert.False(all.canSee(direct))
+
+	public := newChannelViewer("town-square")
+	assert.True(public.canSee(open))
+	assert.False(public.canSee(private))
+	assert.False(public.canSee(direct))
+
+	members := newChannelViewer("private")
+	assert.True(members.canSee(private))
+	assert.False(newChannelViewer("direct").canSee(direct))
+
+	user := newMemberViewer(map[string]bool{"private": true, "direct": true})
+	assert.True(user.canSee(open))
+	assert.True(user.canSee(private))
+	assert.False(user.canSee(&model.Channel{Id: "left", Type: model.CHANNEL_PRIVATE}))
+	assert.False(user.canSee(direct))
+}
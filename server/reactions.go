@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+// countReaction add a reaction on a post in an analytic, caller must hold the write lock
+func countReaction(a *Analytic, post *model.Post, reaction *model.Reaction) {
+	a.ReactionsGiven[reaction.UserId]++
+	a.ReactionsReceived[post.UserId]++
+	a.Emojis[reaction.EmojiName]++
+	a.ChannelsReactions[post.ChannelId]++
+	incrementChannelUser(a.ChannelsReactionsGiven, post.ChannelId, reaction.UserId)
+	incrementChannelUser(a.ChannelsReactionsReceived, post.ChannelId, post.UserId)
+	incrementChannelUser(a.ChannelsEmojis, post.ChannelId, reaction.EmojiName)
+}
+
+// pollPostReactions count reactions of a post added between since and until, in milliseconds
+func (p *Plugin) pollPostReactions(post *model.Post, since int64, until int64) error {
+	reactions, appErr := p.API.GetReactions(post.Id)
+	if appErr != nil {
+		return errors.Wrap(appErr, "can't get reactions of post "+post.Id)
+	}
+	p.currentAnalytic.WLock()
+	defer p.currentAnalytic.WUnlock()
+	for _, reaction := range reactions {
+		if reaction.CreateAt > since && reaction.CreateAt <= until {
+			countReaction(p.currentAnalytic, post, reaction)
+		}
+	}
+	return nil
+}
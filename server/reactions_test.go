@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountReaction(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAnalytic()
+	post := &model.Post{Id: "post1", UserId: "author", ChannelId: "chan1"}
+	countReaction(a, post, &model.Reaction{UserId: "user1", PostId: "post1", EmojiName: "+1"})
+	countReaction(a, post, &model.Reaction{UserId: "user2", PostId: "post1", EmojiName: "+1"})
+	countReaction(a, &model.Post{Id: "post2", UserId: "user1", ChannelId: "chan2"}, &model.Reaction{UserId: "author", PostId: "post2", EmojiName: "tada"})
+
+	assert.Equal(int64(2), a.ReactionsReceived["author"])
+	assert.Equal(int64(1), a.ReactionsGiven["author"])
+	assert.Equal(int64(2), a.Emojis["+1"])
+	assert.Equal(int64(2), a.ChannelsReactions["chan1"])
+
+	filtered := a.FilterChannels(func(channelID string) bool { return channelID == "chan1" })
+	assert.Equal(int64(2), filtered.ReactionsReceived["author"])
+	assert.Equal(int64(0), filtered.ReactionsGiven["author"])
+	assert.Equal(map[string]int64{"+1": 2}, filtered.Emojis)
+
+	emojis := prepareEmojis(a.Emojis)
+	assert.Equal("+1", emojis[0].name)
+	assert.Equal("tada", emojis[1].name)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/mattermost/mattermost-server/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	// resolverTTL is how long names are cached, users have no update hook so a renamed user
+	// is seen after it or when the user logs in again
+	resolverTTL = 15 * time.Minute
+	// resolverBulkThreshold is the number of missing channels or users from which they are loaded page by page
+	resolverBulkThreshold = 20
+	resolverPerPage       = 200
+)
+
+// ttlCache is a map whose entries expire
+type ttlCache struct {
+	lock    sync.RWMutex
+	ttl     time.Duration
+	entries map[string]ttlEntry
+}
+
+type ttlEntry struct {
+	value  interface{}
+	expire time.Time
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{ttl: ttl, entries: make(map[string]ttlEntry)}
+}
+
+// get return the value of a key, an expired entry is deleted
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.lock.RLock()
+	entry, ok := c.entries[key]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expire) {
+		c.lock.Lock()
+		// the entry may have been set again since it was read
+		if current, ok := c.entries[key]; ok && time.Now().After(current.expire) {
+			delete(c.entries, key)
+		}
+		c.lock.Unlock()
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache) set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = ttlEntry{value: value, expire: time.Now().Add(c.ttl)}
+}
+
+func (c *ttlCache) delete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, key)
+}
+
+// sweep delete all expired entries, entries which are never read again would else be kept forever
+func (c *ttlCache) sweep() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expire) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// nameResolver cache channels, teams and users used to display reports
+// so that each one is asked once to mattermost whatever the number of reports and buckets
+type nameResolver struct {
+	channels *ttlCache
+	teams    *ttlCache
+	users    *ttlCache
+}
+
+func newNameResolver() *nameResolver {
+	return &nameResolver{
+		channels: newTTLCache(resolverTTL),
+		teams:    newTTLCache(resolverTTL),
+		users:    newTTLCache(resolverTTL),
+	}
+}
+
+// sweep delete expired entries of all caches, called each hour
+func (r *nameResolver) sweep() {
+	r.channels.sweep()
+	r.teams.sweep()
+	r.users.sweep()
+}
+
+// getResolver return the resolver, created on first use
+func (p *Plugin) getResolver() *nameResolver {
+	p.resolverOnce.Do(func() {
+		p.resolver = newNameResolver()
+	})
+	return p.resolver
+}
+
+// getChannel return a channel from the cache or from mattermost
+func (p *Plugin) getChannel(channelID string) (*model.Channel, error) {
+	if channel, ok := p.getResolver().channels.get(channelID); ok {
+		return channel.(*model.Channel), nil
+	}
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get channel "+channelID)
+	}
+	p.getResolver().channels.set(channelID, channel)
+	return channel, nil
+}
+
+// getTeam return a team from the cache or from mattermost
+// teams are few, so all of them are loaded on the first miss
+func (p *Plugin) getTeam(teamID string) (*model.Team, error) {
+	if team, ok := p.getResolver().teams.get(teamID); ok {
+		return team.(*model.Team), nil
+	}
+	teams, appErr := p.API.GetTeams()
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get teams")
+	}
+	for _, team := range teams {
+		p.getResolver().teams.set(team.Id, team)
+	}
+	if team, ok := p.getResolver().teams.get(teamID); ok {
+		return team.(*model.Team), nil
+	}
+	team, appErr := p.API.GetTeam(teamID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get team "+teamID)
+	}
+	p.getResolver().teams.set(teamID, team)
+	return team, nil
+}
+
+// getUser return a user from the cache or from mattermost
+func (p *Plugin) getUser(userID string) (*model.User, error) {
+	if user, ok := p.getResolver().users.get(userID); ok {
+		return user.(*model.User), nil
+	}
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get user "+userID)
+	}
+	p.getResolver().users.set(userID, user)
+	return user, nil
+}
+
+// prefetchChannels load public channels of all teams page by page when many channels are missing
+// remaining channels, private ones or direct messages, are then asked one by one
+func (p *Plugin) prefetchChannels(channelIDs map[string]int64) {
+	if countMissing(p.getResolver().channels, channelIDs) < resolverBulkThreshold {
+		return
+	}
+	teams, appErr := p.API.GetTeams()
+	if appErr != nil {
+		p.API.LogWarn("can't get teams to prefetch channels", "err", appErr.Error())
+		return
+	}
+	for _, team := range teams {
+		p.getResolver().teams.set(team.Id, team)
+		for page := 0; ; page++ {
+			channels, appErr := p.API.GetPublicChannelsForTeam(team.Id, page, resolverPerPage)
+			if appErr != nil {
+				p.API.LogWarn("can't prefetch channels", "teamID", team.Id, "err", appErr.Error())
+				break
+			}
+			for _, channel := range channels {
+				p.getResolver().channels.set(channel.Id, channel)
+			}
+			if len(channels) < resolverPerPage {
+				break
+			}
+		}
+	}
+}
+
+// prefetchUsers load users of all teams page by page when many users are missing
+func (p *Plugin) prefetchUsers(userIDs map[string]int64) {
+	if countMissing(p.getResolver().users, userIDs) < resolverBulkThreshold {
+		return
+	}
+	teams, appErr := p.API.GetTeams()
+	if appErr != nil {
+		p.API.LogWarn("can't get teams to prefetch users", "err", appErr.Error())
+		return
+	}
+	for _, team := range teams {
+		for page := 0; ; page++ {
+			users, appErr := p.API.GetUsersInTeam(team.Id, page, resolverPerPage)
+			if appErr != nil {
+				p.API.LogWarn("can't prefetch users", "teamID", team.Id, "err", appErr.Error())
+				break
+			}
+			for _, user := range users {
+				p.getResolver().users.set(user.Id, user)
+			}
+			if len(users) < resolverPerPage {
+				break
+			}
+		}
+	}
+}
+
+func countMissing(cache *ttlCache, keys map[string]int64) int {
+	missing := 0
+	for key := range keys {
+		if _, ok := cache.get(key); !ok {
+			missing++
+		}
+	}
+	return missing
+}
+
+// invalidateChannel forget a channel when a system message tells it changed
+// mattermost has no hook for channel updates, but posts these messages in the channel
+func (p *Plugin) invalidateChannel(post *model.Post) {
+	switch post.Type {
+	case model.POST_DISPLAYNAME_CHANGE, model.POST_CHANGE_CHANNEL_PRIVACY, model.POST_CHANNEL_DELETED:
+		p.getResolver().channels.delete(post.ChannelId)
+	}
+}
+
+// UserHasLoggedIn is called by mattermost when a user logs in
+// used to refresh the cached user, mattermost has no hook for user updates
+func (p *Plugin) UserHasLoggedIn(c *plugin.Context, user *model.User) {
+	p.getResolver().users.set(user.Id, user)
+}
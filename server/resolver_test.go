@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTLCache(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := newTTLCache(time.Hour)
+	_, ok := cache.get("a")
+	assert.False(ok)
+
+	cache.set("a", "value")
+	value, ok := cache.get("a")
+	assert.True(ok)
+	assert.Equal("value", value)
+	assert.Equal(0, countMissing(cache, map[string]int64{"a": 1}))
+	assert.Equal(1, countMissing(cache, map[string]int64{"a": 1, "b": 2}))
+
+	cache.delete("a")
+	_, ok = cache.get("a")
+	assert.False(ok)
+
+	expired := newTTLCache(-time.Second)
+	expired.set("a", "value")
+	_, ok = expired.get("a")
+	assert.False(ok)
+	assert.Len(expired.entries, 0)
+
+	expired.set("b", "value")
+	expired.sweep()
+	assert.Len(expired.entries, 0)
+}
@@ -2,20 +2,38 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	// currentAnalyticKey stored the current bucket before each node of a cluster had its own key
+	currentAnalyticKey = "analytics"
+	bucketsIndexKey    = "analyticsIndex"
+	// legacyBucketsKey stored all closed sessions in one value before buckets were split in their own keys
+	legacyBucketsKey = "allAnalytics"
+	// bucketsCacheDuration is how long closed buckets are kept in memory, the history read by default reports
+	bucketsCacheDuration = defaultTrendsDuration + activityLookback*24*time.Hour
+)
+
 func (p *Plugin) retreiveData() error {
-	j, err := p.API.KVGet("analytics")
+	j, err := p.API.KVGet(p.nodeCurrentKey())
 	if err != nil {
 		return errors.Wrap(err, "failed to get analytics from kv")
 	}
 	p.currentAnalytic = NewAnalytic()
-	if err := json.Unmarshal(j, p.currentAnalytic); err != nil {
-		p.API.LogError("failed to unmarshal analytics from kv use new one", "err", err.Error())
-		p.currentAnalytic = NewAnalytic()
+	if len(j) == 0 {
+		return nil
+	}
+	a, errD := p.decodeOrQuarantine(p.nodeCurrentKey(), j)
+	if errD != nil {
+		p.API.LogError("failed to decode analytics from kv use new one", "err", errD.Error())
+		return nil
 	}
+	p.currentAnalytic = a
 	return nil
 }
 
@@ -23,48 +41,379 @@ func (p *Plugin) saveCurrentAnalytic() error {
 	p.currentAnalytic.RLock()
 	defer p.currentAnalytic.RUnlock()
 
-	j, err := json.Marshal(p.currentAnalytic)
+	j, err := encodeAnalytic(p.currentAnalytic)
 	if err != nil {
 		return errors.Wrap(err, "can't marshal internal analytics data")
 	}
-	if err := p.API.KVSet("analytics", j); err != nil {
+	if err := p.API.KVSet(p.nodeCurrentKey(), j); err != nil {
 		return errors.Wrap(err, "can't save analytics data")
 	}
 	return nil
 }
 
-func (p *Plugin) allSessions() ([]*Analytic, error) {
-	allAnalytics := make([]*Analytic, 0)
+// bucketRef is an entry of the buckets index, each closed bucket is stored under its own key
+type bucketRef struct {
+	Start time.Time
+	End   time.Time
+	// Saved is when the bucket was last written in nanoseconds, so copies in cache are read again
+	Saved int64 `json:",omitempty"`
+}
+
+func (b bucketRef) key() string {
+	return fmt.Sprintf("analytics-%d-%d", b.Start.Unix(), b.End.Unix())
+}
+
+// bucketsIndex return references of all closed buckets, oldest first
+// on first call it splits legacy sessions stored in one value in their own keys
+func (p *Plugin) bucketsIndex() ([]bucketRef, error) {
+	index := make([]bucketRef, 0)
 
-	j, err := p.API.KVGet("allAnalytics")
+	j, err := p.API.KVGet(bucketsIndexKey)
 	if err != nil {
-		p.API.LogError("can't get allAnalytics", "err", err.Error())
-		return nil, err
+		return nil, errors.Wrap(err, "can't get buckets index")
+	}
+	if len(j) == 0 {
+		return p.migrateLegacyBuckets()
 	}
 
-	if err := json.Unmarshal(j, &allAnalytics); err != nil {
-		p.API.LogError("failed to unmarshal analytics from kv use new one", "err", err.Error())
-		return nil, err
+	if err := json.Unmarshal(j, &index); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal buckets index")
+	}
+	return index, nil
+}
+
+func (p *Plugin) saveBucketsIndex(index []bucketRef) error {
+	sort.Slice(index, func(i, j int) bool {
+		return index[i].Start.Before(index[j].Start)
+	})
+	j, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal buckets index")
+	}
+	if err := p.API.KVSet(bucketsIndexKey, j); err != nil {
+		return errors.Wrap(err, "can't save buckets index")
+	}
+	return nil
+}
+
+func (p *Plugin) loadBucket(ref bucketRef) (*Analytic, error) {
+	j, err := p.API.KVGet(ref.key())
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get bucket")
 	}
+	return p.decodeOrQuarantine(ref.key(), j)
+}
 
-	return allAnalytics, nil
+// saveBucket write a closed bucket, the returned ref must replace the one in the index
+func (p *Plugin) saveBucket(bucket *Analytic) (bucketRef, error) {
+	ref := bucketRef{Start: bucket.Start, End: bucket.End, Saved: time.Now().UnixNano()}
+	j, err := encodeAnalytic(bucket)
+	if err != nil {
+		return ref, errors.Wrap(err, "can't marshal bucket")
+	}
+	if err := p.API.KVSet(ref.key(), j); err != nil {
+		return ref, errors.Wrap(err, "can't save bucket")
+	}
+	return ref, nil
 }
 
-func (p *Plugin) newSession() {
+// migrateLegacyBuckets move each session of the legacy value in its own key and build the index
+func (p *Plugin) migrateLegacyBuckets() ([]bucketRef, error) {
+	index := make([]bucketRef, 0)
+
+	j, err := p.API.KVGet(legacyBucketsKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get legacy buckets")
+	}
+	if len(j) == 0 {
+		return index, nil
+	}
+
+	legacy := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(j, &legacy); err != nil {
+		// the whole value is kept in quarantine, so migration can go on without it
+		if errQ := p.quarantine(legacyBucketsKey, j, err); errQ != nil {
+			return nil, errQ
+		}
+	}
+	for _, raw := range legacy {
+		bucket, err := p.decodeOrQuarantine(legacyBucketsKey, raw)
+		if err != nil {
+			continue
+		}
+		ref, err := p.saveBucket(bucket)
+		if err != nil {
+			return nil, err
+		}
+		index = append(index, ref)
+	}
+	if err := p.saveBucketsIndex(index); err != nil {
+		return nil, err
+	}
+	if err := p.API.KVDelete(legacyBucketsKey); err != nil {
+		p.API.LogWarn("can't delete legacy buckets", "err", err.Error())
+	}
+	p.API.LogInfo("legacy sessions migrated to buckets", "nb", len(index))
+	return index, nil
+}
+
+// rolloverBucket close the current bucket if its time is over and store it as a partial of this node
+// the leader merges partials of all nodes in closed buckets
+// it does nothing if current bucket is still the one of now
+func (p *Plugin) rolloverBucket() {
 	p.currentAnalytic.WLock()
 	defer p.currentAnalytic.WUnlock()
 
-	allAnalytics, err := p.allSessions()
+	now := bucketStart(time.Now())
+	if !p.currentAnalytic.Start.Before(now) {
+		return
+	}
+
+	// after a downtime the bucket ends with its hour, not when the plugin restarted
+	end := bucketStart(p.currentAnalytic.Start).Add(bucketDuration)
+	if end.After(now) {
+		end = now
+	}
+	closed := p.currentAnalytic.Rollover(end)
+	p.currentAnalytic.Start = now
+	if err := p.savePartial(closed); err != nil {
+		// keep counting in the same bucket, it will be closed on next try
+		p.API.LogError("failed to save partial, current bucket is kept", "err", err.Error())
+		p.currentAnalytic.Merge(closed)
+		p.currentAnalytic.Start = closed.Start
+		return
+	}
+
+	j, err := encodeAnalytic(p.currentAnalytic)
+	if err != nil {
+		p.API.LogError("can't marshal internal analytics data", "err", err.Error())
+		return
+	}
+	// the closed bucket must not stay under the node key, else it would be counted twice
+	if err := p.API.KVSet(p.nodeCurrentKey(), j); err != nil {
+		p.API.LogError("can't save analytics data", "err", err.Error())
+	}
+}
+
+// applyRetention compact buckets older than CompactAfterDays in one bucket by day
+// and delete buckets older than RetentionDays
+func (p *Plugin) applyRetention() {
+	p.historyLock.Lock()
+	defer p.historyLock.Unlock()
+
+	index, err := p.bucketsIndex()
 	if err != nil {
-		p.API.LogWarn("can't get all sessions", "err", err.Error())
+		p.API.LogError("can't get buckets index", "err", err.Error())
+		return
 	}
 
-	j2, err2 := json.Marshal(append(allAnalytics, p.currentAnalytic.Close()))
-	if err2 != nil {
-		p.API.LogWarn("can't marshal internal analytics data")
+	now := time.Now()
+	kept := make([]bucketRef, 0, len(index))
+	days := make(map[time.Time][]bucketRef)
+	retentionDays := p.getConfiguration().getRetentionDays()
+	compactAfterDays := p.getConfiguration().getCompactAfterDays()
+	for _, ref := range index {
+		if retentionDays > 0 && ref.End.Before(now.AddDate(0, 0, -retentionDays)) {
+			if err := p.API.KVDelete(ref.key()); err != nil {
+				p.API.LogWarn("can't delete bucket", "key", ref.key(), "err", err.Error())
+				kept = append(kept, ref)
+			}
+			continue
+		}
+		day := dayStart(ref.Start)
+		if compactAfterDays > 0 && ref.End.Before(now.AddDate(0, 0, -compactAfterDays)) && !ref.End.After(day.AddDate(0, 0, 1)) {
+			days[day] = append(days[day], ref)
+			continue
+		}
+		kept = append(kept, ref)
 	}
-	if err := p.API.KVSet("allAnalytics", j2); err != nil {
-		p.API.LogError("failed to send allAnalytics to kv", "err", err.Error())
+
+	for day, refs := range days {
+		if len(refs) == 1 {
+			kept = append(kept, refs[0])
+			continue
+		}
+		ref, err := p.compactBuckets(day, refs)
+		if err != nil {
+			p.API.LogWarn("can't compact buckets", "day", day.String(), "err", err.Error())
+			kept = append(kept, refs...)
+			continue
+		}
+		kept = append(kept, ref)
+	}
+
+	if err := p.saveBucketsIndex(kept); err != nil {
+		p.API.LogError("failed to save buckets index", "err", err.Error())
+	}
+}
+
+// compactBuckets merge all buckets of a day in one bucket and delete them
+func (p *Plugin) compactBuckets(day time.Time, refs []bucketRef) (bucketRef, error) {
+	compacted := NewAnalytic()
+	compacted.Start = day
+	compacted.End = day.AddDate(0, 0, 1)
+	for _, ref := range refs {
+		bucket, err := p.loadBucket(ref)
+		if err != nil {
+			return bucketRef{}, err
+		}
+		compacted.Merge(bucket)
+	}
+
+	compactedRef, err := p.saveBucket(compacted)
+	if err != nil {
+		return compactedRef, err
+	}
+	for _, ref := range refs {
+		if ref.key() == compactedRef.key() {
+			continue
+		}
+		if err := p.API.KVDelete(ref.key()); err != nil {
+			p.API.LogWarn("can't delete compacted bucket", "key", ref.key(), "err", err.Error())
+		}
+	}
+	return compactedRef, nil
+}
+
+// dayStart return the local midnight of the day of t
+func dayStart(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// history is the buckets read by a report, loaded once and shared by all its sections
+type history struct {
+	buckets []*Analytic
+}
+
+// loadHistory load closed buckets starting since since, buckets of other nodes not merged yet
+// and a copy of the current bucket, a zero since loads all buckets
+func (p *Plugin) loadHistory(since time.Time) *history {
+	h := &history{buckets: make([]*Analytic, 0)}
+	pe := period{since: since}
+	index, err := p.bucketsIndex()
+	if err != nil {
+		p.API.LogError("can't get buckets index", "err", err.Error())
 	}
-	p.currentAnalytic.Init()
+	for _, ref := range index {
+		if !pe.contains(ref.Start) {
+			continue
+		}
+		bucket, err := p.cachedBucket(ref)
+		if err != nil {
+			p.API.LogWarn("can't load bucket", "key", ref.key(), "err", err.Error())
+			continue
+		}
+		h.buckets = append(h.buckets, bucket)
+	}
+	p.evictBuckets(index)
+	for _, bucket := range p.openBuckets() {
+		if pe.contains(bucket.Start) {
+			h.buckets = append(h.buckets, bucket)
+		}
+	}
+
+	current := NewAnalytic()
+	p.currentAnalytic.RLock()
+	current.Start = p.currentAnalytic.Start
+	current.End = p.currentAnalytic.End
+	current.Merge(p.currentAnalytic)
+	p.currentAnalytic.RUnlock()
+	h.buckets = append(h.buckets, current)
+	return h
+}
+
+// cachedBucket load a closed bucket, from memory when it wasn't written since it was read
+// buckets older than bucketsCacheDuration are read from kv each time, buckets in cache are never changed
+func (p *Plugin) cachedBucket(ref bucketRef) (*Analytic, error) {
+	cacheable := ref.Start.After(time.Now().Add(-bucketsCacheDuration))
+	key := cachedBucketKey(ref)
+	if cacheable {
+		p.bucketsCacheLock.Lock()
+		bucket, ok := p.bucketsCache[key]
+		p.bucketsCacheLock.Unlock()
+		if ok {
+			return bucket, nil
+		}
+	}
+
+	bucket, err := p.loadBucket(ref)
+	if err != nil || !cacheable {
+		return bucket, err
+	}
+	p.bucketsCacheLock.Lock()
+	defer p.bucketsCacheLock.Unlock()
+	if p.bucketsCache == nil {
+		p.bucketsCache = make(map[string]*Analytic)
+	}
+	p.bucketsCache[key] = bucket
+	return bucket, nil
+}
+
+// evictBuckets remove from cache buckets written again, compacted, deleted or older than bucketsCacheDuration
+func (p *Plugin) evictBuckets(index []bucketRef) {
+	since := time.Now().Add(-bucketsCacheDuration)
+	valid := make(map[string]bool, len(index))
+	for _, ref := range index {
+		if ref.Start.After(since) {
+			valid[cachedBucketKey(ref)] = true
+		}
+	}
+
+	p.bucketsCacheLock.Lock()
+	defer p.bucketsCacheLock.Unlock()
+	for key := range p.bucketsCache {
+		if !valid[key] {
+			delete(p.bucketsCache, key)
+		}
+	}
+}
+
+func cachedBucketKey(ref bucketRef) string {
+	return fmt.Sprintf("%s-%d", ref.key(), ref.Saved)
+}
+
+// between return an analytic merging all buckets starting in the period
+func (h *history) between(pe period) *Analytic {
+	merged := NewAnalytic()
+	merged.Start = pe.since
+	merged.End = pe.until
+	for _, bucket := range h.buckets {
+		if pe.contains(bucket.Start) {
+			merged.Merge(bucket)
+		}
+	}
+	return merged
+}
+
+// byStep split a period in consecutive analytics of step duration, used to draw trends
+// each bucket is merged in the step containing its start
+func (h *history) byStep(pe period, step time.Duration) []*Analytic {
+	end := pe.end()
+	steps := make([]*Analytic, 0)
+	for start := pe.since; start.Before(end); start = start.Add(step) {
+		a := NewAnalytic()
+		a.Start = start
+		a.End = start.Add(step)
+		steps = append(steps, a)
+	}
+	if len(steps) == 0 {
+		return steps
+	}
+	for _, bucket := range h.buckets {
+		if pe.contains(bucket.Start) {
+			steps[int(bucket.Start.Sub(pe.since)/step)].Merge(bucket)
+		}
+	}
+	return steps
+}
+
+// analyticBetween return an analytic merging all buckets, current one included, starting in the period
+func (p *Plugin) analyticBetween(pe period) *Analytic {
+	return p.loadHistory(pe.since).between(pe)
+}
+
+// analyticsByStep split a period in consecutive analytics of step duration, see history.byStep
+func (p *Plugin) analyticsByStep(pe period, step time.Duration) []*Analytic {
+	return p.loadHistory(pe.since).byStep(pe, step)
 }
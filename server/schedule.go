@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron"
+)
+
+const (
+	defaultReportSchedule = "@weekly"
+	// maxScheduleLookBack is how far the previous run of a schedule is searched, enough for @yearly
+	maxScheduleLookBack = 2 * 366 * 24 * time.Hour
+	lastReportKeyPrefix = "lastReport-"
+	// maxLateReports is the number of most recent missed reports sent on activation, older ones are skipped
+	maxLateReports = 10
+)
+
+// reportSchedule is when a report is sent and in which channels
+type reportSchedule struct {
+	spec       string
+	schedule   cron.Schedule
+	channelsID []string
+	// teams are team ids of destinations receiving the report of their team by channel id
+	teams map[string]string
+	// key stores the time of the last report sent, it changes with the schedule or its channels
+	key string
+}
+
+func newReportSchedule(spec string, timeZone string, schedule cron.Schedule, channelsID []string) *reportSchedule {
+	sum := sha1.Sum([]byte(spec + " " + timeZone + " " + strings.Join(channelsID, ",")))
+	return &reportSchedule{
+		spec:       spec,
+		schedule:   schedule,
+		channelsID: channelsID,
+		key:        fmt.Sprintf("%s%x", lastReportKeyPrefix, sum[:8]),
+	}
+}
+
+// channelSchedule is a schedule of one destination in ChannelsSchedules, like `team/channel=0 9 * * MON Europe/Paris`
+type channelSchedule struct {
+	teamChannel string
+	spec        string
+	timeZone    string
+}
+
+// zonedSchedule run a schedule in a time zone, whatever the time zone of the server
+type zonedSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+func (z zonedSchedule) Next(t time.Time) time.Time {
+	return z.schedule.Next(t.In(z.location))
+}
+
+// parseSchedule parse a standard cron expression (5 fields or a descriptor like @weekly) in a time zone
+// an empty time zone is the one of the server
+func parseSchedule(spec string, timeZone string) (cron.Schedule, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad cron expression %q", spec)
+	}
+	if timeZone == "" {
+		return schedule, nil
+	}
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad time zone %q", timeZone)
+	}
+	return zonedSchedule{schedule: schedule, location: location}, nil
+}
+
+// splitScheduleZone split a cron expression followed by an optional time zone
+func splitScheduleZone(value string) (string, string, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return "", "", errors.New("empty schedule")
+	}
+	nb := 5
+	if fields[0] == "@every" {
+		nb = 2
+	} else if strings.HasPrefix(fields[0], "@") {
+		nb = 1
+	}
+	switch len(fields) {
+	case nb:
+		return strings.Join(fields, " "), "", nil
+	case nb + 1:
+		return strings.Join(fields[:nb], " "), fields[nb], nil
+	default:
+		return "", "", fmt.Errorf("bad schedule %q, expected a cron expression and an optional time zone", value)
+	}
+}
+
+// parseChannelsSchedules parse schedules of destinations, separated by `;` as cron expressions can contain `,`
+func parseChannelsSchedules(value string) ([]channelSchedule, error) {
+	schedules := make([]channelSchedule, 0)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		index := strings.Index(entry, "=")
+		if index < 0 {
+			return nil, fmt.Errorf("bad schedule %q, expected TeamName/ChannelName=schedule", entry)
+		}
+		teamChannel := strings.TrimSpace(entry[:index])
+		if strings.Count(teamChannel, "/") != 1 {
+			return nil, fmt.Errorf("bad channel %q, expected TeamName/ChannelName", teamChannel)
+		}
+		spec, timeZone, err := splitScheduleZone(entry[index+1:])
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, channelSchedule{teamChannel: teamChannel, spec: spec, timeZone: timeZone})
+	}
+	return schedules, nil
+}
+
+// lastRun return the last time the schedule ran at or before t, zero if it didn't run recently
+func lastRun(schedule cron.Schedule, t time.Time) time.Time {
+	back := time.Minute
+	for schedule.Next(t.Add(-back)).After(t) {
+		if back > maxScheduleLookBack {
+			return time.Time{}
+		}
+		back *= 2
+	}
+	run := schedule.Next(t.Add(-back))
+	for next := schedule.Next(run); !next.After(t); next = schedule.Next(run) {
+		run = next
+	}
+	return run
+}
+
+// reportPeriod return the period covered by a scheduled report run at t: since the previous run
+func reportPeriod(schedule cron.Schedule, t time.Time) period {
+	current := lastRun(schedule, t)
+	if current.IsZero() {
+		return period{}
+	}
+	previous := lastRun(schedule, current.Add(-time.Second))
+	if previous.IsZero() {
+		return period{}
+	}
+	return period{since: previous, until: current}
+}
+
+// runSchedule send the report of a schedule, called by cron
+func (p *Plugin) runSchedule(schedule *reportSchedule) {
+	p.rolloverBucket()
+	if !p.acquireLeadership() {
+		return // another node of the cluster sends the report
+	}
+	now := time.Now()
+	run := lastRun(schedule.schedule, now)
+	if !p.claimRun(schedule.key, run) {
+		return // already sent by another node
+	}
+	if err := p.sendAnalytics(reportPeriod(schedule.schedule, now), schedule); err != nil {
+		p.API.LogError("can't send post", "schedule", schedule.spec, "err", err.Error())
+		return
+	}
+	p.saveLastReport(schedule, run)
+}
+
+// catchUpSchedules find reports of all schedules missed while the plugin was stopped
+// they are sent labelled as late if SendLateReports is set, else they are only skipped
+func (p *Plugin) catchUpSchedules() {
+	now := time.Now()
+	for _, schedule := range p.getSchedules() {
+		if len(schedule.channelsID) == 0 {
+			continue
+		}
+		last, err := p.loadLastReport(schedule)
+		if err != nil {
+			p.API.LogError("can't get last report", "schedule", schedule.spec, "err", err.Error())
+			continue
+		}
+		if last.IsZero() {
+			// a new schedule has no missed report
+			p.saveLastReport(schedule, lastRun(schedule.schedule, now))
+			continue
+		}
+
+		missed, nbMissed := missedRuns(schedule.schedule, last, now)
+		if nbMissed == 0 {
+			continue
+		}
+		p.API.LogInfo("reports missed while stopped", "schedule", schedule.spec, "nb", nbMissed)
+
+		if p.getConfiguration().SendLateReports {
+			for _, pe := range missed {
+				if !p.claimRun(schedule.key, pe.until) {
+					continue // already sent by another node
+				}
+				if err := p.sendLateAnalytics(pe, schedule); err != nil {
+					p.API.LogError("can't send late report", "schedule", schedule.spec, "err", err.Error())
+					break
+				}
+				p.saveLastReport(schedule, pe.until)
+			}
+			continue
+		}
+		p.saveLastReport(schedule, missed[len(missed)-1].until)
+	}
+}
+
+// missedRuns return periods of the most recent runs of a schedule between last and now, and the number of missed runs
+func missedRuns(schedule cron.Schedule, last time.Time, now time.Time) ([]period, int) {
+	missed := make([]period, 0)
+	nb := 0
+	for run := schedule.Next(last); !run.After(now); run = schedule.Next(run) {
+		missed = append(missed, period{since: last, until: run})
+		if len(missed) > maxLateReports {
+			missed = missed[1:]
+		}
+		last = run
+		nb++
+	}
+	return missed, nb
+}
+
+// sendLateAnalytics send a report missed while the plugin was stopped
+func (p *Plugin) sendLateAnalytics(pe period, schedule *reportSchedule) error {
+	for _, channelID := range schedule.channelsID {
+		attachments, err := p.buildScheduledAttachments(pe, schedule, channelID)
+		if err != nil {
+			return errors.Wrap(err, "can't build analytics attachments")
+		}
+		attachments[0].Pretext = fmt.Sprintf(":hourglass: Late report, it was due on %s while analytics were stopped.", pe.until.Format("January 2, 2006 at 15:04"))
+		if err := p.postAttachments(channelID, attachments); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) loadLastReport(schedule *reportSchedule) (time.Time, error) {
+	j, err := p.API.KVGet(schedule.key)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "can't get last report")
+	}
+	if len(j) == 0 {
+		return time.Time{}, nil
+	}
+	unix, errP := strconv.ParseInt(string(j), 10, 64)
+	if errP != nil {
+		return time.Time{}, errors.Wrap(errP, "can't parse last report")
+	}
+	return time.Unix(unix, 0), nil
+}
+
+func (p *Plugin) saveLastReport(schedule *reportSchedule, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if err := p.API.KVSet(schedule.key, []byte(strconv.FormatInt(t.Unix(), 10))); err != nil {
+		p.API.LogError("can't save last report", "schedule", schedule.spec, "err", err.Error())
+	}
+}
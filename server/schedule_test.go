@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChannelsSchedules(t *testing.T) {
+	assert := assert.New(t)
+
+	schedules, err := parseChannelsSchedules("team1/chan1=0 9 * * MON,WED Europe/Paris; team2/chan2=@daily;")
+	assert.Nil(err)
+	assert.Equal([]channelSchedule{
+		{teamChannel: "team1/chan1", spec: "0 9 * * MON,WED", timeZone: "Europe/Paris"},
+		{teamChannel: "team2/chan2", spec: "@daily"},
+	}, schedules)
+
+	_, err = parseChannelsSchedules("team1/chan1")
+	assert.EqualError(err, `bad schedule "team1/chan1", expected TeamName/ChannelName=schedule`)
+
+	_, err = parseChannelsSchedules("team1/chan1=0 9 * *")
+	assert.EqualError(err, `bad schedule "0 9 * *", expected a cron expression and an optional time zone`)
+
+	_, err = parseSchedule("0 9 * * MON", "Mars/Olympus")
+	assert.NotNil(err)
+	_, err = parseSchedule("0 25 * * MON", "")
+	assert.NotNil(err)
+
+	// the hourly job fires when buckets start, even with a half hour offset
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	assert.Nil(err)
+	hourly, err := parseSchedule("@hourly", "UTC")
+	assert.Nil(err)
+	now := time.Date(2019, 4, 22, 10, 10, 0, 0, kolkata)
+	assert.True(bucketStart(now).Add(bucketDuration).Equal(hourly.Next(now)))
+}
+
+func TestReportPeriod(t *testing.T) {
+	assert := assert.New(t)
+
+	utc, err := parseSchedule("0 9 * * MON-FRI", "UTC")
+	assert.Nil(err)
+	// a monday report covers the weekend since friday
+	monday := time.Date(2019, 4, 22, 9, 0, 0, 500, time.UTC)
+	pe := reportPeriod(utc, monday)
+	assert.True(time.Date(2019, 4, 19, 9, 0, 0, 0, time.UTC).Equal(pe.since))
+	assert.True(time.Date(2019, 4, 22, 9, 0, 0, 0, time.UTC).Equal(pe.until))
+
+	monthly, err := parseSchedule("@monthly", "Asia/Tokyo")
+	assert.Nil(err)
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	pe = reportPeriod(monthly, time.Date(2019, 3, 1, 0, 0, 1, 0, tokyo))
+	assert.True(time.Date(2019, 2, 1, 0, 0, 0, 0, tokyo).Equal(pe.since))
+	assert.True(time.Date(2019, 3, 1, 0, 0, 0, 0, tokyo).Equal(pe.until))
+}
+
+func TestMissedRuns(t *testing.T) {
+	assert := assert.New(t)
+
+	daily, err := parseSchedule("0 9 * * *", "UTC")
+	assert.Nil(err)
+	last := time.Date(2019, 4, 1, 9, 0, 0, 0, time.UTC)
+
+	missed, nb := missedRuns(daily, last, time.Date(2019, 4, 1, 18, 0, 0, 0, time.UTC))
+	assert.Equal(0, nb)
+	assert.Empty(missed)
+
+	missed, nb = missedRuns(daily, last, time.Date(2019, 4, 3, 10, 0, 0, 0, time.UTC))
+	assert.Equal(2, nb)
+	assert.Len(missed, 2)
+	assert.True(last.Equal(missed[0].since))
+	assert.True(time.Date(2019, 4, 3, 9, 0, 0, 0, time.UTC).Equal(missed[1].until))
+
+	missed, nb = missedRuns(daily, last, time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC))
+	assert.Equal(30, nb)
+	assert.Len(missed, maxLateReports)
+	assert.True(time.Date(2019, 4, 21, 9, 0, 0, 0, time.UTC).Equal(missed[0].since))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	sourceHuman   = "human"
+	sourceBot     = "bot"
+	sourceWebhook = "webhook"
+	sourceSystem  = "system"
+	sourcePlugin  = "plugin"
+)
+
+// integrationSources are sources of posts not sent by humans, in the order of reports
+var integrationSources = []string{sourceBot, sourceWebhook, sourcePlugin, sourceSystem}
+
+// getPostSource classify a post by what sent it, see classifyPost
+func (p *Plugin) getPostSource(post *model.Post) string {
+	return classifyPost(post, p.BotUserID, p.getConfiguration().botUserIDs)
+}
+
+// classifyPost return the source of a post
+// plugins mark their posts with from_plugin, reports sent by previous versions of this plugin are webhooks of its user
+// the user of this plugin can be a person, its own messages are human ones
+// bot accounts are the users listed in BotAccounts, mattermost doesn't flag them
+func classifyPost(post *model.Post, pluginUserID string, bots map[string]bool) string {
+	switch {
+	case post.IsSystemMessage():
+		return sourceSystem
+	case post.Props["from_plugin"] == "true", post.UserId == pluginUserID && post.Props["from_webhook"] == "true":
+		return sourcePlugin
+	case post.Props["from_webhook"] == "true":
+		return sourceWebhook
+	case bots[post.UserId]:
+		return sourceBot
+	default:
+		return sourceHuman
+	}
+}
+
+// countSource add a post in messages by source, caller must hold the write lock
+func countSource(a *Analytic, post *model.Post, source string) {
+	a.Sources[source]++
+	incrementChannelUser(a.ChannelsSources, post.ChannelId, source)
+}
+
+// isCounted return true when posts of a source are counted in messages, rankings and other metrics
+// posts of integrations are only counted by source unless CountIntegrations is set
+func (c *configuration) isCounted(source string) bool {
+	return source == sourceHuman || c.CountIntegrations
+}
+
+// prepareIntegrations build channels lines with messages of integrations, sorted by number of messages
+// caller must hold the read lock
+func (p *Plugin) prepareIntegrations(data *preparedData, a *Analytic) {
+	data.sources = make(map[string]int64, len(a.Sources))
+	mergeCounts(data.sources, a.Sources)
+	for channelID, sources := range a.ChannelsSources {
+		nb := int64(0)
+		for _, source := range integrationSources {
+			nb += sources[source]
+		}
+		if nb == 0 {
+			continue
+		}
+		line := p.resolveChannel(data, channelID)
+		line.nb = nb
+		data.integrations = p.updateOrAppend(data.integrations, line)
+	}
+	sort.Slice(data.integrations, func(i, j int) bool {
+		return data.integrations[i].nb > data.integrations[j].nb
+	})
+}
+
+// getIntegrationsFields tell how many messages were sent by integrations and in which channels
+// nothing is displayed when no integration posted
+func (p *Plugin) getIntegrationsFields(siteURL string, data *preparedData) ([]*model.SlackAttachmentField, error) {
+	integrations := int64(0)
+	total := int64(0)
+	spec := &chartSpec{Kind: pieChart}
+	for source, nb := range data.sources {
+		total += nb
+		if source != sourceHuman {
+			integrations += nb
+		}
+	}
+	if integrations == 0 {
+		return nil, nil
+	}
+	for _, source := range integrationSources {
+		spec.Labels = append(spec.Labels, source)
+		spec.Values = append(spec.Values, float64(data.sources[source]))
+	}
+
+	m := "### Integrations\n"
+	m = m + fmt.Sprintf("#### **%d** messages *(%d%% of all posts)* were sent by integrations: **%d** by bots, **%d** by webhooks, **%d** by plugins and **%d** system messages.\n", integrations, percentOf(integrations, total), data.sources[sourceBot], data.sources[sourceWebhook], data.sources[sourcePlugin], data.sources[sourceSystem])
+	if !p.getConfiguration().CountIntegrations {
+		m = m + "They are not counted in other sections.\n"
+	}
+	for index, line := range data.integrations {
+		if index >= 3 {
+			break
+		}
+		m = m + fmt.Sprintf("* %s: **%d** messages of integrations.\n", getChannelLink(line), line.nb)
+	}
+	urlChart, err := p.saveChart(siteURL, spec)
+	if err != nil {
+		return nil, err
+	}
+	return buildSlackAttachmentField(m, "integrations pie chart", urlChart), nil
+}
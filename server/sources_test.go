@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyPost(t *testing.T) {
+	assert := assert.New(t)
+
+	bots := map[string]bool{"ci": true}
+	assert.Equal(sourceHuman, classifyPost(&model.Post{UserId: "user1"}, "analytics", bots))
+	assert.Equal(sourceBot, classifyPost(&model.Post{UserId: "ci"}, "analytics", bots))
+	assert.Equal(sourceWebhook, classifyPost(&model.Post{UserId: "user1", Props: model.StringInterface{"from_webhook": "true"}}, "analytics", bots))
+	assert.Equal(sourcePlugin, classifyPost(&model.Post{UserId: "analytics", Props: model.StringInterface{"from_webhook": "true"}}, "analytics", bots))
+	assert.Equal(sourceHuman, classifyPost(&model.Post{UserId: "analytics"}, "analytics", bots))
+	assert.Equal(sourcePlugin, classifyPost(&model.Post{UserId: "user1", Props: model.StringInterface{"from_plugin": "true"}}, "analytics", bots))
+	assert.Equal(sourceSystem, classifyPost(&model.Post{UserId: "user1", Type: model.POST_JOIN_CHANNEL}, "analytics", bots))
+
+	a := NewAnalytic()
+	countSource(a, &model.Post{ChannelId: "chan1"}, sourceBot)
+	countSource(a, &model.Post{ChannelId: "chan1"}, sourceHuman)
+	assert.Equal(int64(1), a.Sources[sourceBot])
+	assert.Equal(int64(1), a.ChannelsSources["chan1"][sourceHuman])
+
+	assert.True((&configuration{}).isCounted(sourceHuman))
+	assert.False((&configuration{}).isCounted(sourceBot))
+	assert.True((&configuration{CountIntegrations: true}).isCounted(sourceWebhook))
+}
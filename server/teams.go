@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// getPostTeamID return the team of the channel of a post, empty for direct messages or when it can't be fetched
+func (p *Plugin) getPostTeamID(post *model.Post) string {
+	teamID, err := p.getChannelTeamID(post.ChannelId)
+	if err != nil {
+		p.API.LogWarn("can't get team of channel, post not counted in its team", "channelID", post.ChannelId, "err", err.Error())
+		return ""
+	}
+	return teamID
+}
+
+// countTeam add nb messages of a post in counters of its team, nb is negative to remove a deleted post
+// posts without team are not counted, caller must hold the write lock
+func countTeam(a *Analytic, post *model.Post, teamID string, nb int64) {
+	if teamID == "" {
+		return
+	}
+	a.Teams[teamID] += nb
+	addChannelUser(a.TeamsChannels, teamID, post.ChannelId, nb)
+	addChannelUser(a.TeamsUsers, teamID, post.UserId, nb)
+}
+
+// teamFilter return a function keeping channels of a team, to be given to FilterChannels
+// channels counted in the team by a are kept without fetching them, so deleted channels stay in their team
+// others, like channels of buckets recorded before teams were counted, are fetched
+func (p *Plugin) teamFilter(a *Analytic, teamID string) func(channelID string) bool {
+	a.RLock()
+	counted := make(map[string]bool, len(a.TeamsChannels[teamID]))
+	for channelID := range a.TeamsChannels[teamID] {
+		counted[channelID] = true
+	}
+	a.RUnlock()
+	return func(channelID string) bool {
+		if counted[channelID] {
+			return true
+		}
+		channelTeamID, err := p.getChannelTeamID(channelID)
+		if err != nil {
+			p.API.LogWarn("can't get team of channel", "channelID", channelID, "err", err.Error())
+			return false
+		}
+		return channelTeamID == teamID
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountTeam(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAnalytic()
+	post := &model.Post{UserId: "user1", ChannelId: "chan1"}
+	countPost(a, post, 0)
+	countTeam(a, post, "team1", 1)
+	other := &model.Post{UserId: "user2", ChannelId: "chan2"}
+	countPost(a, other, 0)
+	countTeam(a, other, "team2", 1)
+	countTeam(a, &model.Post{UserId: "user1", ChannelId: "dm"}, "", 1)
+	assert.Equal(map[string]int64{"team1": 1, "team2": 1}, a.Teams)
+	assert.Equal(int64(1), a.TeamsChannels["team1"]["chan1"])
+	assert.Equal(int64(1), a.TeamsUsers["team2"]["user2"])
+
+	filtered := a.FilterChannels(func(channelID string) bool { return channelID == "chan1" })
+	assert.Equal(map[string]int64{"team1": 1}, filtered.Teams)
+	assert.Equal(map[string]int64{"user1": 1}, filtered.TeamsUsers["team1"])
+
+	countTeam(a, post, "team1", -1)
+	assert.Equal(int64(0), a.Teams["team1"])
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// minResponsesToRank is the number of first responses a user needs to be ranked among fastest responders
+	minResponsesToRank = 3
+	maxResponders      = 3
+	threadKeyPrefix    = "thread-"
+	// threadRecordSeconds is how long a thread is remembered after its last reply, a later reply reads the thread again
+	threadRecordSeconds = 30 * 24 * 60 * 60
+)
+
+// responseTimeBounds are upper bounds of the histograms of first response delays
+// medians of buckets recorded before delays were kept by thread are estimated by their bound
+// bounds can be added, a delay counted with a wider bound is still below it
+var responseTimeBounds = []time.Duration{
+	30 * time.Second,
+	time.Minute,
+	2 * time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+	4 * time.Hour,
+	8 * time.Hour,
+	16 * time.Hour,
+	24 * time.Hour,
+	2 * 24 * time.Hour,
+	3 * 24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// responseTimeOverflow is the histogram key of delays longer than all bounds
+const responseTimeOverflow = "inf"
+
+// threadReply is what a reply changes in its thread
+type threadReply struct {
+	// firstResponse is true for the first reply of another user than the author of the root post
+	firstResponse bool
+	delay         time.Duration
+	// newParticipant is true when the author of the reply never posted in the thread before
+	newParticipant bool
+}
+
+// threadRecord is what is known of a thread to count its replies without reading it, stored in kv by root post id
+// nodes of a cluster count replies with their own copy, so two replies posted at once on two nodes
+// can both be counted as the first response
+type threadRecord struct {
+	RootUserID   string
+	RootCreateAt int64
+	Answered     bool
+	// Participants are users who replied, the author of the root post excluded
+	Participants map[string]bool
+}
+
+// queueReply add a reply to the queue of flushReplies, so posting doesn't wait for kv
+func (p *Plugin) queueReply(post *model.Post) {
+	p.repliesLock.Lock()
+	defer p.repliesLock.Unlock()
+
+	p.pendingReplies = append(p.pendingReplies, post)
+}
+
+// flushReplies count threads metrics of queued replies in the current bucket, in the order they were posted
+// it's called each minute, before closing the bucket and when the plugin stops
+func (p *Plugin) flushReplies() {
+	p.threadsLock.Lock()
+	defer p.threadsLock.Unlock()
+
+	p.repliesLock.Lock()
+	posts := p.pendingReplies
+	p.pendingReplies = nil
+	p.repliesLock.Unlock()
+	if len(posts) == 0 {
+		return
+	}
+
+	replies := make([]*threadReply, len(posts))
+	for index, post := range posts {
+		reply, err := p.getThreadReply(post)
+		if err != nil {
+			p.API.LogWarn("can't get thread of reply", "postID", post.Id, "err", err.Error())
+			continue
+		}
+		replies[index] = reply
+	}
+
+	p.currentAnalytic.WLock()
+	defer p.currentAnalytic.WUnlock()
+	for index, post := range posts {
+		if replies[index] != nil {
+			countThreadReply(p.currentAnalytic, post, replies[index])
+		}
+	}
+}
+
+// getThreadReply tell if a reply is the first response of its thread and its delay
+// the thread is read once, then its record is updated with each reply, caller must hold threadsLock
+func (p *Plugin) getThreadReply(post *model.Post) (*threadReply, error) {
+	rootID := post.RootId
+	if rootID == "" {
+		rootID = post.ParentId
+	}
+
+	record, err := p.loadThreadRecord(rootID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		thread, appErr := p.API.GetPostThread(rootID)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "can't get thread "+rootID)
+		}
+		root, ok := thread.Posts[rootID]
+		if !ok {
+			return nil, errors.New("root post not found in thread " + rootID)
+		}
+		record = newThreadRecord(root, post, thread.Posts)
+	}
+	reply := record.reply(post)
+	if err := p.saveThreadRecord(rootID, record); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// newThreadRecord build the record of a thread from its posts created before post
+func newThreadRecord(root *model.Post, post *model.Post, posts map[string]*model.Post) *threadRecord {
+	record := &threadRecord{RootUserID: root.UserId, RootCreateAt: root.CreateAt, Participants: make(map[string]bool)}
+	for _, other := range posts {
+		if other.Id == post.Id || other.Id == root.Id || other.UserId == root.UserId {
+			continue
+		}
+		if other.CreateAt > post.CreateAt || (other.CreateAt == post.CreateAt && other.Id > post.Id) {
+			continue
+		}
+		record.Answered = true
+		record.Participants[other.UserId] = true
+	}
+	return record
+}
+
+// reply return what a reply changes in the thread and add it to the record
+func (record *threadRecord) reply(post *model.Post) *threadReply {
+	if post.UserId == record.RootUserID {
+		return &threadReply{}
+	}
+	reply := &threadReply{
+		firstResponse:  !record.Answered,
+		delay:          time.Duration(post.CreateAt-record.RootCreateAt) * time.Millisecond,
+		newParticipant: !record.Participants[post.UserId],
+	}
+	record.Answered = true
+	record.Participants[post.UserId] = true
+	return reply
+}
+
+func (p *Plugin) loadThreadRecord(rootID string) (*threadRecord, error) {
+	j, appErr := p.API.KVGet(threadKeyPrefix + rootID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "can't get thread record")
+	}
+	if len(j) == 0 {
+		return nil, nil
+	}
+	record := &threadRecord{}
+	if err := json.Unmarshal(j, record); err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal thread record")
+	}
+	if record.Participants == nil {
+		record.Participants = make(map[string]bool)
+	}
+	return record, nil
+}
+
+func (p *Plugin) saveThreadRecord(rootID string, record *threadRecord) error {
+	j, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal thread record")
+	}
+	if appErr := p.API.KVSetWithExpiry(threadKeyPrefix+rootID, j, threadRecordSeconds); appErr != nil {
+		return errors.Wrap(appErr, "can't save thread record")
+	}
+	return nil
+}
+
+// countThreadReply add a reply in threads metrics of an analytic, caller must hold the write lock
+func countThreadReply(a *Analytic, post *model.Post, reply *threadReply) {
+	if reply.newParticipant {
+		a.ChannelsParticipants[post.ChannelId]++
+	}
+	if !reply.firstResponse {
+		return
+	}
+	seconds := int64(reply.delay / time.Second)
+	a.ChannelsAnswered[post.ChannelId]++
+	incrementChannelUser(a.ChannelsResponseTimes, post.ChannelId, responseTimeKey(reply.delay))
+	a.UsersFirstResponses[post.UserId]++
+	a.UsersResponseTime[post.UserId] += seconds
+	incrementChannelUser(a.ChannelsUsersFirstResponses, post.ChannelId, post.UserId)
+	addChannelUser(a.ChannelsUsersResponseTime, post.ChannelId, post.UserId, seconds)
+}
+
+// responseTimeKey return the histogram key of a delay, the number of seconds of its upper bound
+func responseTimeKey(delay time.Duration) string {
+	for _, bound := range responseTimeBounds {
+		if delay <= bound {
+			return strconv.FormatInt(int64(bound/time.Second), 10)
+		}
+	}
+	return responseTimeOverflow
+}
+
+// responseTimeQuantile return the upper bound of the delay of the q quantile of an histogram
+// false is returned when the quantile is beyond the last bound
+func responseTimeQuantile(histogram map[string]int64, q float64) (time.Duration, bool) {
+	total := int64(0)
+	for _, nb := range histogram {
+		total += nb
+	}
+	if total == 0 {
+		return 0, false
+	}
+	cumulated := int64(0)
+	for _, bound := range responseTimeBounds {
+		cumulated += histogram[strconv.FormatInt(int64(bound/time.Second), 10)]
+		if float64(cumulated) >= q*float64(total) {
+			return bound, true
+		}
+	}
+	return 0, false
+}
+
+// threadsData is a channel line of the threads section of a report
+type threadsData struct {
+	channel      analyticsData
+	threads      int64
+	replies      int64
+	answered     int64
+	participants int64
+	median       string
+	p90          string
+}
+
+// responderData is a user line of the fastest responders
+type responderData struct {
+	user      analyticsData
+	responses int64
+	average   time.Duration
+}
+
+// prepareThreads build threads lines of channels with root posts, sorted by number of threads
+// threads are root posts of the period, answered are first responses of the period, so a thread
+// answered after the end of the period is counted as unanswered. Caller must hold the read lock
+func (p *Plugin) prepareThreads(data *preparedData, a *Analytic, keep func(channelID string) bool) {
+	for channelID, nb := range a.Channels {
+		if !keep(channelID) {
+			continue
+		}
+		threads := nb - a.ChannelsReply[channelID]
+		answered := a.ChannelsAnswered[channelID]
+		if threads <= 0 && answered == 0 {
+			continue
+		}
+		line := threadsData{
+			channel:      p.resolveChannel(data, channelID),
+			threads:      threads,
+			replies:      a.ChannelsReply[channelID],
+			answered:     answered,
+			participants: a.ChannelsParticipants[channelID],
+			median:       formatResponseTime(a.ChannelsResponseTimes[channelID], 0.5),
+			p90:          formatResponseTime(a.ChannelsResponseTimes[channelID], 0.9),
+		}
+		if line.channel.name == dmOrPrivateChannelName {
+			continue
+		}
+		data.threads = append(data.threads, line)
+	}
+	sort.Slice(data.threads, func(i, j int) bool {
+		if data.threads[i].threads == data.threads[j].threads {
+			return data.threads[i].channel.id < data.threads[j].channel.id
+		}
+		return data.threads[i].threads > data.threads[j].threads
+	})
+}
+
+// prepareResponders build users lines sorted by average delay of their first responses
+// users are left out like in prepareUsers
+// caller must hold the read lock of the analytic owning these maps
+func (p *Plugin) prepareResponders(data *preparedData, firstResponses map[string]int64, responseTime map[string]int64) {
+	privacy := p.getUserPrivacy(data)
+	if privacy.hidden {
+		return
+	}
+	for userID, responses := range firstResponses {
+		if responses < minResponsesToRank {
+			continue
+		}
+		user := p.resolveUser(data, userID)
+		if !privacy.ranked(user) {
+			continue
+		}
+		average := time.Duration(responseTime[userID]/responses) * time.Second
+		data.responders = append(data.responders, responderData{user: user, responses: responses, average: average})
+	}
+	sort.Slice(data.responders, func(i, j int) bool {
+		if data.responders[i].average == data.responders[j].average {
+			return data.responders[i].responses > data.responders[j].responses
+		}
+		return data.responders[i].average < data.responders[j].average
+	})
+}
+
+// formatResponseTime return the q quantile of an histogram like "≤ 15m"
+func formatResponseTime(histogram map[string]int64, q float64) string {
+	if len(histogram) == 0 {
+		return "-"
+	}
+	bound, ok := responseTimeQuantile(histogram, q)
+	if !ok {
+		return "> " + formatDelay(responseTimeBounds[len(responseTimeBounds)-1])
+	}
+	return "≤ " + formatDelay(bound)
+}
+
+// formatDelay return a short humanized delay like 5m, 2h or 3d
+func formatDelay(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
+
+// getThreadsFields display response times of the most active channels and the fastest responders
+// nothing is displayed when no thread was started
+func getThreadsFields(data *preparedData) []*model.SlackAttachmentField {
+	if len(data.threads) == 0 {
+		return nil
+	}
+	m := "### Threads\n"
+	for index, line := range data.threads {
+		if index >= maxChannelsToDisplay {
+			break
+		}
+		unanswered := int64(0)
+		if line.threads > line.answered {
+			unanswered = percentOf(line.threads-line.answered, line.threads)
+		}
+		replies := 0.0
+		if line.threads > 0 {
+			replies = float64(line.replies) / float64(line.threads)
+		}
+		participants := 0.0
+		if line.answered > 0 {
+			// authors of root posts are participants of answered threads too
+			participants = float64(line.participants+line.answered) / float64(line.answered)
+		}
+		m = m + fmt.Sprintf("* %s: **%d** threads, first response median %s, p90 %s, **%d%%** unanswered, %.1f replies and %.1f participants by thread.\n", getChannelLink(line.channel), line.threads, line.median, line.p90, unanswered, replies, participants)
+	}
+	if len(data.responders) > 0 {
+		m = m + "#### Fastest responders\n"
+		for index, responder := range data.responders {
+			if index >= maxResponders {
+				break
+			}
+			m = m + fmt.Sprintf("* %s: first response in **%s** on average, %d threads.\n", getUserMention(responder.user), formatDelay(responder.average), responder.responses)
+		}
+	}
+	return []*model.SlackAttachmentField{{Short: false, Value: m}}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThreadReply(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &model.Post{Id: "root", UserId: "author", ChannelId: "chan1", CreateAt: 0}
+	own := &model.Post{Id: "own", UserId: "author", ChannelId: "chan1", RootId: "root", CreateAt: 1000}
+	first := &model.Post{Id: "first", UserId: "user1", ChannelId: "chan1", RootId: "root", CreateAt: 120000}
+	second := &model.Post{Id: "second", UserId: "user1", ChannelId: "chan1", RootId: "root", CreateAt: 180000}
+	posts := map[string]*model.Post{"root": root, "own": own, "first": first, "second": second}
+
+	assert.Equal(&threadReply{}, newThreadRecord(root, own, posts).reply(own))
+	assert.Equal(&threadReply{firstResponse: true, delay: 2 * time.Minute, newParticipant: true}, newThreadRecord(root, first, posts).reply(first))
+	assert.Equal(&threadReply{firstResponse: false, delay: 3 * time.Minute, newParticipant: false}, newThreadRecord(root, second, posts).reply(second))
+
+	// replies after the first one are counted from the record only
+	record := newThreadRecord(root, own, posts)
+	firstReply := record.reply(first)
+	assert.Equal(&threadReply{firstResponse: false, delay: 3 * time.Minute, newParticipant: false}, record.reply(second))
+	third := &model.Post{Id: "third", UserId: "user2", ChannelId: "chan1", RootId: "root", CreateAt: 240000}
+	assert.Equal(&threadReply{firstResponse: false, delay: 4 * time.Minute, newParticipant: true}, record.reply(third))
+
+	a := NewAnalytic()
+	countThreadReply(a, first, firstReply)
+	assert.Equal(int64(1), a.ChannelsAnswered["chan1"])
+	assert.Equal(int64(1), a.ChannelsResponseTimes["chan1"]["120"])
+	assert.Equal(int64(120), a.UsersResponseTime["user1"])
+
+	histogram := map[string]int64{"60": 5, "300": 3, "3600": 2}
+	median, ok := responseTimeQuantile(histogram, 0.5)
+	assert.True(ok)
+	assert.Equal(time.Minute, median)
+	assert.Equal("≤ 1h", formatResponseTime(histogram, 0.9))
+	assert.Equal("> 7d", formatResponseTime(map[string]int64{responseTimeOverflow: 1}, 0.5))
+	assert.Equal(responseTimeOverflow, responseTimeKey(30*24*time.Hour))
+
+	// delays counted before finer bounds were added stay below their wider bound
+	assert.Equal("≤ 5m", formatResponseTime(map[string]int64{"120": 1, "300": 2}, 0.5))
+}
+
+func TestFilterThreads(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAnalytic()
+	a.ChannelsParticipants["chan1"] = 2
+	a.ChannelsParticipants["chan2"] = 1
+	filtered := a.FilterChannels(func(channelID string) bool { return channelID == "chan1" })
+	assert.Equal(map[string]int64{"chan1": 2}, filtered.ChannelsParticipants)
+}